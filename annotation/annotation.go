@@ -1,8 +1,8 @@
 package annotation
 
 import (
-	"bufio"
-	"log"
+	"fmt"
+	"io"
 	"math"
 	"os"
 	"runtime/debug"
@@ -15,8 +15,15 @@ import (
 )
 
 var (
-	debugElementsFile = "bamstats-coverage.elements.bed"
-	dumpElementsEnv   = "BAMSTATS_DUMP_ELEMENTS"
+	// transcriptElements are indexed as they are, without deriving further elements from them
+	transcriptElements = []string{
+		"CDS",
+		"UTR",
+		"five_prime_utr",
+		"three_prime_utr",
+		"start_codon",
+		"stop_codon",
+	}
 )
 
 type chunk struct {
@@ -27,6 +34,7 @@ type chunk struct {
 type tree struct {
 	chr  string
 	tree *rtreego.Rtree
+	err  error
 }
 
 // RtreeMap is a map of pointers to Rtree with string keys.
@@ -47,16 +55,47 @@ func (t RtreeMap) Len() int {
 	return len(t)
 }
 
-func scan(scanner *Scanner, regions chan chunk) {
+// HasElements returns true if the index contains features of any of the given elements.
+func (t RtreeMap) HasElements(elements ...string) bool {
+	found := false
+	filter := func(results []rtreego.Spatial, object rtreego.Spatial) (refuse, abort bool) {
+		if found {
+			return true, true
+		}
+		for _, e := range elements {
+			if object.(*Feature).Element() == e {
+				found = true
+				break
+			}
+		}
+		return true, found
+	}
+	bb, _ := rtreego.NewRect(rtreego.Point{0}, []float64{math.MaxFloat64})
+	for _, rt := range t {
+		if rt == nil {
+			continue
+		}
+		rt.SearchIntersect(bb, filter)
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func scan(scanner *Scanner, regions chan chunk) (err error) {
+	regMap := make(map[string]chan rtreego.Spatial)
 	defer func() {
+		for ref := range regMap {
+			close(regMap[ref])
+		}
 		close(regions)
 		if r := recover(); r != nil {
 			logrus.Debugf("%s", debug.Stack())
-			os.Exit(1)
+			err = fmt.Errorf("error reading annotation file at line %d: %v", scanner.Line(), r)
 		}
 	}()
 
-	regMap := make(map[string]chan rtreego.Spatial)
 	var chr string
 	for scanner.Next() {
 		feature := scanner.Feat()
@@ -71,42 +110,32 @@ func scan(scanner *Scanner, regions chan chunk) {
 		}
 		regMap[chr] <- feature
 	}
-	for ref := range regMap {
-		close(regMap[ref])
-	}
-	if scanner.Error() != nil {
-		logrus.Panic(scanner.Error())
+	if err := scanner.Error(); err != nil {
+		return fmt.Errorf("error reading annotation file: %v", err)
 	}
+	unmatched := scanner.r.chrs.UnmatchedString()
 	nChroms := len(regMap)
 	if nChroms == 0 {
-		logrus.Panic("Error reading annotation file: no chromosomes found")
+		if unmatched != "" {
+			return fmt.Errorf("error reading annotation file: no chromosomes found in the BAM header. Unmatched chromosomes: %s", unmatched)
+		}
+		return fmt.Errorf("error reading annotation file: no chromosomes found")
 	}
-	logrus.Infof("Annotation scanned: %d chromosomes found", len(regMap))
-}
-
-func writeElements(items <-chan rtreego.Spatial, done chan<- struct{}) {
-	var w *bufio.Writer
-	out, _ := os.Create(debugElementsFile)
-	w = bufio.NewWriter(out)
-	logrus.Debugf("Writing index elements to %s", out.Name())
-	itemSlice := NewFeatureSlice(chan2slice(items))
-	sort.Sort(itemSlice)
-	for _, item := range itemSlice {
-		w.WriteString(item.Out())
-		w.WriteRune('\n')
+	if unmatched != "" {
+		logrus.Warnf("Annotation chromosomes not found in the BAM header, features skipped: %s", unmatched)
 	}
-	w.Flush()
-	done <- struct{}{}
+	logrus.Infof("Annotation scanned: %d chromosomes found", nChroms)
+	return nil
 }
 
-func mergeIntervals(in []rtreego.Spatial) []*Feature {
+func mergeIntervals(in []rtreego.Spatial) ([]*Feature, error) {
 	intervals := NewFeatureSlice(in)
 	sort.Sort(intervals)
 	var out []*Feature
 	var x *Feature
 	for n, f := range intervals {
 		if n == 0 {
-			x = f
+			x = f.Clone()
 		}
 		if n > 0 {
 			if f.Start() <= x.End() {
@@ -116,19 +145,19 @@ func mergeIntervals(in []rtreego.Spatial) []*Feature {
 				size := end - start
 				rect, err := rtreego.NewRect(loc, []float64{size})
 				if err != nil {
-					log.Panic(err)
+					return nil, fmt.Errorf("error merging %s intervals on %s: %v", x.Element(), x.Chr(), err)
 				}
 				x.SetBounds(rect)
 			} else {
 				out = append(out, x)
-				x = f
+				x = f.Clone()
 			}
 		}
 		if n == len(intervals)-1 {
 			out = append(out, x)
 		}
 	}
-	return out
+	return out, nil
 }
 
 func interleaveFeatures(features []*Feature, start, end float64, element string, updated []byte, extremes bool) []*Feature {
@@ -182,12 +211,14 @@ func getGenes(index *rtreego.Rtree, start, end float64) []rtreego.Spatial {
 				end,
 			)
 			if err == nil {
-				f.SetTags(l[0].tags)
-				for k := range f.tags {
-					if !strings.HasPrefix(k, "gene") {
-						delete(f.tags, k)
+				f.SetStrand(l[0].strand)
+				tags := make(map[string][]byte)
+				for k, v := range l[0].tags {
+					if strings.HasPrefix(k, "gene") {
+						tags[k] = v
 					}
 				}
+				f.SetTags(tags)
 				genes = append(genes, f)
 			}
 		}
@@ -195,9 +226,9 @@ func getGenes(index *rtreego.Rtree, start, end float64) []rtreego.Spatial {
 	return genes
 }
 
-func updateIndex(index *rtreego.Rtree, start, end float64, elems chan rtreego.Spatial) *rtreego.Rtree {
+func updateIndex(index *rtreego.Rtree, start, end float64) (*rtreego.Rtree, error) {
 	if end-start <= 0 {
-		return index
+		return index, nil
 	}
 
 	var features []rtreego.Spatial
@@ -207,30 +238,71 @@ func updateIndex(index *rtreego.Rtree, start, end float64, elems chan rtreego.Sp
 		f := i.(*Feature)
 		features = append(features, f)
 	}
-	mergedGenes := mergeIntervals(genes)
+	mergedGenes, err := mergeIntervals(genes)
+	if err != nil {
+		return nil, err
+	}
 	for _, f := range interleaveFeatures(mergedGenes, start, end, "gene", []byte("intergenic"), true) {
 		if f.Element() == "intergenic" {
 			features = append(features, f)
-			if os.Getenv(dumpElementsEnv) != "" {
-				elems <- f
-			}
 		}
 		exons := QueryIndexByElement(index, f.Start(), f.End(), "exon")
 		for _, i := range exons {
 			f := i.(*Feature)
 			features = append(features, f)
 		}
-		mergedExons := mergeIntervals(exons)
+		mergedExons, err := mergeIntervals(exons)
+		if err != nil {
+			return nil, err
+		}
 		for _, g := range interleaveFeatures(mergedExons, f.Start(), f.End(), "exon", []byte("intron"), false) {
 			if g.Element() == "intron" {
 				features = append(features, g)
-				if os.Getenv(dumpElementsEnv) != "" {
-					elems <- g
-				}
 			}
 		}
 	}
-	return rtreego.NewTree(1, 25, 50, features...)
+	for _, elem := range transcriptElements {
+		features = append(features, QueryIndexByElement(index, start, end, elem)...)
+	}
+	return rtreego.NewTree(1, 25, 50, features...), nil
+}
+
+// assignUTRs replaces generic UTR elements with five_prime_utr or three_prime_utr elements,
+// based on the UTR position with respect to the coding region of the transcript and its strand.
+// UTRs belonging to transcripts without coding features are left unchanged.
+func assignUTRs(features []rtreego.Spatial) {
+	coding := make(map[string][2]float64)
+	for _, i := range features {
+		f := i.(*Feature)
+		switch f.Element() {
+		case "CDS", "start_codon":
+			id := f.Tag("transcript_id")
+			c, ok := coding[id]
+			if !ok {
+				c = [2]float64{f.Start(), f.End()}
+			}
+			coding[id] = [2]float64{math.Min(c[0], f.Start()), math.Max(c[1], f.End())}
+		}
+	}
+	for _, i := range features {
+		f := i.(*Feature)
+		if f.Element() != "UTR" {
+			continue
+		}
+		c, ok := coding[f.Tag("transcript_id")]
+		if !ok {
+			continue
+		}
+		upstream := f.End() <= c[0]
+		if !upstream && f.Start() < c[1] {
+			continue
+		}
+		if upstream == (f.Strand() != "-") {
+			f.element = []byte("five_prime_utr")
+		} else {
+			f.element = []byte("three_prime_utr")
+		}
+	}
 }
 
 func chan2slice(c <-chan rtreego.Spatial) []rtreego.Spatial {
@@ -241,68 +313,95 @@ func chan2slice(c <-chan rtreego.Spatial) []rtreego.Spatial {
 	return s
 }
 
-func createTree(trees chan *tree, chr string, length float64, feats chan rtreego.Spatial, wg *sync.WaitGroup, elems chan rtreego.Spatial) {
-	wg.Add(1)
+func createTree(trees chan *tree, chr string, length float64, feats chan rtreego.Spatial, wg *sync.WaitGroup) {
+	defer wg.Done()
 	featSlice := chan2slice(feats)
+	assignUTRs(featSlice)
 	tmpIndex := rtreego.NewTree(1, 25, 50, featSlice...)
-	t := tree{chr, updateIndex(tmpIndex, 0, length, elems)}
-	trees <- &t
-	if os.Getenv(dumpElementsEnv) != "" && length == 0 {
-		for _, f := range featSlice {
-			elems <- f.(*Feature)
-		}
-	}
-	wg.Done()
+	index, err := updateIndex(tmpIndex, 0, length)
+	trees <- &tree{chr, index, err}
+}
+
+// IndexOptions holds the settings used for reading an annotation when creating its index.
+type IndexOptions struct {
+	// ChrAliases maps annotation chromosome names to BAM reference names.
+	ChrAliases map[string]string
+	// BiotypeTag is the attribute holding the gene biotypes in BED files written by WriteElements.
+	// It defaults to gene_type.
+	BiotypeTag string
 }
 
 // CreateIndex creates the Rtree indices for the specified annotation file. It builds a Rtree
-// for each chromosome and returns a RtreeMap having the chromosome names as keys.
+// for each chromosome and returns a RtreeMap having the chromosome names as keys. It returns
+// nil if the index cannot be created, use CreateIndexWithOptions for getting the error.
 func CreateIndex(annoFile string, chrLens map[string]int) *RtreeMap {
-	f, err := os.Open(annoFile)
+	index, err := CreateIndexWithOptions(annoFile, chrLens, IndexOptions{})
 	if err != nil {
+		logrus.Errorf("Cannot create index for %s: %v", annoFile, err)
 		return nil
 	}
-	scanner := NewScanner(f, chrLens)
+	return index
+}
+
+// CreateIndexWithOptions creates the Rtree indices for the specified annotation file, as
+// CreateIndex does. Annotation chromosomes are matched against the BAM references in chrLens,
+// using the optional aliases.
+func CreateIndexWithOptions(annoFile string, chrLens map[string]int, opts IndexOptions) (*RtreeMap, error) {
+	f, err := os.Open(annoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return CreateIndexFromReader(f, chrLens, opts)
+}
+
+// CreateIndexFromReader creates the Rtree indices for the annotation read from r, as CreateIndex does.
+func CreateIndexFromReader(r io.Reader, chrLens map[string]int, opts IndexOptions) (*RtreeMap, error) {
+	scanner := NewScanner(r, chrLens)
+	scanner.SetChrAliases(opts.ChrAliases)
+	scanner.SetBiotypeTag(opts.BiotypeTag)
 
 	return createIndex(scanner)
 }
 
-func createIndex(scanner *Scanner) *RtreeMap {
+func createIndex(scanner *Scanner) (*RtreeMap, error) {
 	trees := make(RtreeMap)
 	regions := make(chan chunk)
 	treeChan := make(chan *tree)
-	debugElements := make(chan rtreego.Spatial)
-	debugElemsDone := make(chan struct{})
-
-	if os.Getenv(dumpElementsEnv) != "" {
-		go writeElements(debugElements, debugElemsDone)
-	}
-
-	go scan(scanner, regions)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- scan(scanner, regions)
+	}()
 
 	var wg sync.WaitGroup
 	for chunk := range regions {
 		chr := chunk.chr
 		feats := chunk.feats
-		length := float64(scanner.r.chrLens[chr])
-		go createTree(treeChan, chr, length, feats, &wg, debugElements)
+		length := float64(scanner.r.chrs.Len(chr))
+		wg.Add(1)
+		go createTree(treeChan, chr, length, feats, &wg)
 	}
 
 	go func() {
 		wg.Wait()
 		close(treeChan)
-		close(debugElements)
 	}()
 
+	var treeErr error
 	for t := range treeChan {
+		if t.err != nil && treeErr == nil {
+			treeErr = t.err
+		}
 		trees[t.chr] = t.tree
 	}
 
-	if os.Getenv(dumpElementsEnv) != "" {
-		<-debugElemsDone
+	if err := <-errc; err != nil {
+		return nil, err
 	}
-
-	return &trees
+	if treeErr != nil {
+		return nil, treeErr
+	}
+	return &trees, nil
 }
 
 // QueryIndex perform a SearchIntersect on the specified index given a start and end position.
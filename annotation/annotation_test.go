@@ -3,10 +3,9 @@ package annotation
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"regexp"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/dhconnelly/rtreego"
@@ -41,6 +40,25 @@ func TestParseFeature(t *testing.T) {
 	}
 }
 
+func TestCreateIndexErrors(t *testing.T) {
+	for _, item := range []struct {
+		data []byte
+		chrs map[string]int
+	}{
+		{[]byte(""), map[string]int{"chr1": 1000}},
+		{[]byte("chr2\t10\t20\texon\n"), map[string]int{"chr1": 1000}},
+		{[]byte("chr1\t10\t20\texon\nchr1\t30\n"), map[string]int{"chr1": 1000}},
+		{[]byte{0x1f, 0x8b, 0x00}, map[string]int{"chr1": 1000}},
+	} {
+		if _, err := CreateIndexFromReader(bytes.NewReader(item.data), item.chrs, IndexOptions{}); err == nil {
+			t.Errorf("(CreateIndexFromReader) expected error for %q", item.data)
+		}
+	}
+	if _, err := CreateIndexWithOptions("missing.gtf", nil, IndexOptions{}); err == nil {
+		t.Error("(CreateIndexWithOptions) expected error for a missing file")
+	}
+}
+
 func TestCreateIndex(t *testing.T) {
 	elements := []byte(`chr1	11868	12227	exon
 chr2	12612	12721	exon
@@ -59,7 +77,10 @@ chr14	29533	30039	exon
 chr15	30266	30667	exon
 chr16	30975	31109	exon
 `)
-	index := createIndex(NewScanner(bytes.NewReader(elements), map[string]int{}))
+	index, err := createIndex(NewScanner(bytes.NewReader(elements), map[string]int{}))
+	if err != nil {
+		t.Fatal(err)
+	}
 	l := index.Len()
 	isTab := func(c rune) bool {
 		return c == '\n'
@@ -118,7 +139,10 @@ chr1	30266	30667	exon
 chr1	30667	30975	intron
 chr1	30975	31109	exon
 `)
-	index := createIndex(NewScanner(bytes.NewReader(elements), map[string]int{}))
+	index, err := createIndex(NewScanner(bytes.NewReader(elements), map[string]int{}))
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, item := range []struct {
 		query          Location
 		expectedLength int
@@ -214,7 +238,10 @@ func TestMergeIntervals(t *testing.T) {
 			location: newRect(rtreego.Point{13221}, []float64{1188}, t),
 		},
 	}
-	results := mergeIntervals(elements)
+	results, err := mergeIntervals(elements)
+	if err != nil {
+		t.Fatalf("(MergeElements) unexpected error: %v", err)
+	}
 	if len(results) != len(expected) {
 		t.Errorf("(MergeElements) Lengths of merged results differ from expected results.\ngot: %v \nexp: %v)", len(results), len(expected))
 	}
@@ -226,37 +253,69 @@ func TestMergeIntervals(t *testing.T) {
 }
 
 func TestWriteElements(t *testing.T) {
-	elements := []byte(`chr1	11868	12227	exon
-chr2	12612	12721	exon
-chr3	12974	13052	exon
-chr4	13220	14501	exon
-chr5	15004	15038	exon
-chr6	15795	15947	exon
-chr7	16606	16765	exon
-chr8	16857	17055	exon
-chr9	17232	17436	exon
-chr10	17605	17742	exon
-chr11	17914	18061	exon
-chr12	18267	18366	exon
-chr13	24737	24891	exon
-chr14	29533	30039	exon
-chr15	30266	30667	exon
-chr16	30975	31109	exon
+	gtf := []byte(`chr1	test	gene	101	500	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	test	exon	101	200	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	test	exon	151	250	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	test	exon	401	500	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	test	gene	451	700	.	-	.	gene_id "g2"; gene_type "lncRNA";
+chr1	test	exon	451	700	.	-	.	gene_id "g2"; gene_type "lncRNA";
 `)
-	os.Setenv(dumpElementsEnv, "yes")
-	debugElementsFile = ".test.debug.elfile.bed"
-	_ = createIndex(NewScanner(bytes.NewReader(elements), map[string]int{}))
-	e, err := ioutil.ReadFile(debugElementsFile)
-	if os.IsNotExist(err) {
-		t.Fatal("(createIndex) Debug elements file not found")
+	expected := map[Format]string{
+		BED: `chr1	0	100	intergenic	0	.	.	.
+chr1	100	500	gene	0	+	g1	protein_coding
+chr1	100	250	exon	0	+	g1	protein_coding
+chr1	250	400	intron	0	+	g1	protein_coding
+chr1	400	700	exon	0	.	g1,g2	lncRNA,protein_coding
+chr1	450	700	gene	0	-	g2	lncRNA
+chr1	700	1000	intergenic	0	.	.	.
+chr2	0	500	intergenic	0	.	.	.
+`,
+		GTF: `chr1	bamstats	intergenic	1	100	.	.	.	.
+chr1	bamstats	gene	101	500	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	bamstats	exon	101	250	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	bamstats	intron	251	400	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	bamstats	exon	401	700	.	.	.	gene_id "g1,g2"; gene_type "lncRNA,protein_coding";
+chr1	bamstats	gene	451	700	.	-	.	gene_id "g2"; gene_type "lncRNA";
+chr1	bamstats	intergenic	701	1000	.	.	.	.
+chr2	bamstats	intergenic	1	500	.	.	.	.
+`,
+	}
+	chrLens := map[string]int{"chr1": 1000, "chr2": 500}
+	index, err := createIndex(NewScanner(bytes.NewReader(gtf), chrLens))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for format, exp := range expected {
+		var out bytes.Buffer
+		if err := WriteElements(&out, index, chrLens, format, "gene_type"); err != nil {
+			t.Fatalf("(WriteElements) %s: unexpected error: %s", format, err)
+		}
+		if out.String() != exp {
+			t.Errorf("(WriteElements) %s output error.\ngot:\n%s\nexp:\n%s", format, out.String(), exp)
+		}
 	}
+
+	// BED round trip with a custom biotype tag
+	gtf = bytes.Replace(gtf, []byte("gene_type"), []byte("gene_biotype"), -1)
+	index, err = createIndex(NewScanner(bytes.NewReader(gtf), map[string]int{"chr1": 1000}))
 	if err != nil {
-		t.Fatalf("(createIndex) Cannot read debug elements file: %s", err)
+		t.Fatal(err)
 	}
-	if bytes.Compare(elements, e) != 0 {
-		t.Fatalf("(createIndex) Debug elements file contents do not match the expected value")
+	var bed bytes.Buffer
+	if err := WriteElements(&bed, index, map[string]int{"chr1": 1000}, BED, "gene_biotype"); err != nil {
+		t.Fatalf("(WriteElements) unexpected error: %s", err)
+	}
+	index, err = CreateIndexFromReader(&bed, map[string]int{"chr1": 1000}, IndexOptions{BiotypeTag: "gene_biotype"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range QueryIndexByElement(index.Get("chr1"), 0, 1000, "gene") {
+		g := g.(*Feature)
+		exp := map[string]string{"g1": "protein_coding", "g2": "lncRNA"}[g.Tag("gene_id")]
+		if g.Tag("gene_biotype") != exp {
+			t.Errorf("(WriteElements) BED round trip biotype of %s: got %q, exp %q", g.Tag("gene_id"), g.Tag("gene_biotype"), exp)
+		}
 	}
-	os.Remove(debugElementsFile)
 }
 
 func TestSortFeatures(t *testing.T) {
@@ -407,7 +466,11 @@ func TestIssue23(t *testing.T) {
 			location: newRect(rtreego.Point{13221}, []float64{1188}, t),
 		},
 	}
-	results := interleaveFeatures(mergeIntervals(elements), 11869, 14409, "exon", []byte("intron"), false)
+	merged, err := mergeIntervals(elements)
+	if err != nil {
+		t.Fatalf("(MergeElements) unexpected error: %v", err)
+	}
+	results := interleaveFeatures(merged, 11869, 14409, "exon", []byte("intron"), false)
 	if len(results) != len(expected) {
 		t.Errorf("(MergeElements) Lengths of merged results differ from expected results.\ngot: %v \nexp: %v)", len(results), len(expected))
 	}
@@ -461,7 +524,10 @@ func TestReadFeatures(t *testing.T) {
 			elems,
 		},
 	} {
-		m := CreateIndex(i.f, chrLens)
+		m, err := CreateIndexWithOptions(i.f, chrLens, IndexOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
 		index := m.Get("chr1")
 		res := make(map[string]int)
 		for _, s := range QueryIndex(index, 0, 248956422) {
@@ -475,3 +541,263 @@ func TestReadFeatures(t *testing.T) {
 		}
 	}
 }
+
+func TestTranscriptElements(t *testing.T) {
+	elements := []byte(`chr1	HAVANA	gene	101	1000	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	HAVANA	exon	101	400	.	+	.	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	exon	601	1000	.	+	.	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	UTR	101	200	.	+	.	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	CDS	201	400	.	+	0	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	start_codon	201	203	.	+	0	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	CDS	601	797	.	+	1	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	stop_codon	798	800	.	+	0	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	UTR	798	1000	.	+	.	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	gene	2001	3000	.	-	.	gene_id "g2"; gene_type "protein_coding";
+chr1	HAVANA	exon	2001	3000	.	-	.	gene_id "g2"; transcript_id "t2";
+chr1	HAVANA	UTR	2001	2200	.	-	.	gene_id "g2"; transcript_id "t2";
+chr1	HAVANA	CDS	2201	2800	.	-	0	gene_id "g2"; transcript_id "t2";
+chr1	HAVANA	UTR	2801	3000	.	-	.	gene_id "g2"; transcript_id "t2";
+chr1	HAVANA	UTR	4001	4100	.	+	.	gene_id "g3"; transcript_id "t3";
+`)
+	index, err := createIndex(NewScanner(bytes.NewReader(elements), map[string]int{"chr1": 5000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []struct {
+		query    Location
+		expected string
+	}{
+		{Location{"chr1", 100, 200}, "five_prime_utr"},
+		{Location{"chr1", 797, 1000}, "three_prime_utr"},
+		{Location{"chr1", 2000, 2200}, "three_prime_utr"},
+		{Location{"chr1", 2800, 3000}, "five_prime_utr"},
+		{Location{"chr1", 4000, 4100}, "UTR"},
+	} {
+		results := QueryIndex(index.Get(item.query.Chrom()), item.query.Start(), item.query.End())
+		found := false
+		for _, r := range results {
+			f := r.(*Feature)
+			if f.Start() == item.query.Start() && f.End() == item.query.End() {
+				found = true
+				if f.Element() != item.expected {
+					t.Errorf("(assignUTRs) %s: expected %s, got %s", item.query.String(), item.expected, f.Element())
+				}
+			}
+		}
+		if !found {
+			t.Errorf("(createIndex) %s: %s feature not found", item.query.String(), item.expected)
+		}
+	}
+	for elem, expected := range map[string]int{"CDS": 3, "start_codon": 1, "stop_codon": 1} {
+		l := len(QueryIndexByElement(index.Get("chr1"), 0, 5000, elem))
+		if l != expected {
+			t.Errorf("(createIndex) expected %d %s features, got %d", expected, elem, l)
+		}
+	}
+}
+
+func TestChrMapper(t *testing.T) {
+	chrLens := map[string]int{
+		"chr1":  1000,
+		"chrM":  1000,
+		"chrUn": 1000,
+		"2":     1000,
+	}
+	aliases, err := readChrAliases(bytes.NewReader([]byte("# annotation\tbam\nGL000220.1\tchrUn\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewChrMapper(chrLens, aliases)
+	for _, item := range []struct {
+		chr, expected string
+	}{
+		{"chr1", "chr1"},
+		{"1", "chr1"},
+		{"MT", "chrM"},
+		{"chrM", "chrM"},
+		{"chr2", "2"},
+		{"GL000220.1", "chrUn"},
+		{"3", ""},
+		{"chrX", ""},
+		{"3", ""},
+	} {
+		chr, ok := m.Map(item.chr)
+		if ok != (item.expected != "") || chr != item.expected {
+			t.Errorf("(ChrMapper) %s: expected %q, got %q", item.chr, item.expected, chr)
+		}
+	}
+	expected := "3 (2), chrX (1)"
+	if u := m.UnmatchedString(); u != expected {
+		t.Errorf("(ChrMapper) expected unmatched chromosomes %q, got %q", expected, u)
+	}
+	if _, err := readChrAliases(bytes.NewReader([]byte("chr1\n"))); err == nil {
+		t.Error("(readChrAliases) expected error for malformed line")
+	}
+}
+
+func TestIndexChrAliases(t *testing.T) {
+	elements := []byte(`1	HAVANA	gene	101	1000	.	+	.	gene_id "g1";
+1	HAVANA	exon	101	400	.	+	.	gene_id "g1"; transcript_id "t1";
+MT	HAVANA	gene	101	1000	.	+	.	gene_id "g2";
+MT	HAVANA	exon	101	1000	.	+	.	gene_id "g2"; transcript_id "t2";
+KI270728.1	HAVANA	gene	101	1000	.	+	.	gene_id "g3";
+`)
+	index, err := createIndex(NewScanner(bytes.NewReader(elements), map[string]int{"chr1": 2000, "chrM": 2000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 2 {
+		t.Errorf("(createIndex) expected 2 chromosomes, got %d", index.Len())
+	}
+	for _, chr := range []string{"chr1", "chrM"} {
+		if index.Get(chr) == nil {
+			t.Errorf("(createIndex) chromosome %s not found in the index", chr)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	elements := []byte(`##description: test annotation
+chr1	HAVANA	gene	101	1000	.	+	.	gene_id "g1";
+chr1	HAVANA	exon	101	400	.	+	.	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	exon	901	1200	.	+	.	gene_id "g1"; transcript_id "t1";
+chr1	HAVANA	gene	2001	2500	.	+	.	gene_id "g2";
+chr1	HAVANA	exon	2001	2100	.	+	.	transcript_id "t3";
+chr1	HAVANA	gene	1501	1800	.	+	.	gene_id "g4";
+chr1	HAVANA	exon	1501	abc	.	+	.	gene_id "g4"; transcript_id "t4";
+chr1	HAVANA	gene	3001	1000	.	+	.	gene_id "g7";
+chr2	HAVANA	gene	101	1000	.	+	.	gene_id "g5";
+chr1	HAVANA	gene	5001	6000	.	+	.	gene_id "g6";
+chr1	HAVANA	exon	5001	6000	.	+	.
+chr1	HAVANA	gene	7001	8000	.	+	.	gene_id "g8";	extra
+`)
+	expected := []string{
+		"line 4: exon chr1:901-1200 outside gene g1 chr1:101-1000 (line 2)",
+		"line 6: missing gene_id attribute",
+		"line 7: unsorted input: chr1:1500-1800:gene starts before the previous feature",
+		"line 8: invalid coordinates 1501-abc",
+		"line 9: invalid coordinates 3001-1000",
+		"line 10: chromosome chr2 not found in the BAM header",
+		"line 11: unsorted input: chromosome chr1 already found at line 2",
+		"line 12: expected 9 fields, got 8",
+		"line 13: expected 9 fields, got 10",
+	}
+	problems, err := Validate(bytes.NewReader(elements), map[string]int{"chr1": 10000}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != len(expected) {
+		t.Errorf("(Validate) expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for i, p := range problems {
+		if i < len(expected) && p.Error() != expected[i] {
+			t.Errorf("(Validate) expected %q, got %q", expected[i], p)
+		}
+	}
+}
+
+func TestHasElements(t *testing.T) {
+	for _, item := range []struct {
+		bed    string
+		coding bool
+	}{
+		{"chr1\t100\t1000\ttx1\t0\t-\n", false},
+		{"chr1\t100\t1000\ttx1\t0\t-\t200\t800\t0\t1\t900,\t0,\n", true},
+	} {
+		index, err := CreateIndexFromReader(strings.NewReader(item.bed), map[string]int{"chr1": 2000}, IndexOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !index.HasElements("exon") {
+			t.Errorf("(HasElements) %q: expected exons", item.bed)
+		}
+		if c := index.HasElements("CDS", "five_prime_utr", "three_prime_utr"); c != item.coding {
+			t.Errorf("(HasElements) %q: expected transcript elements %v, got %v", item.bed, item.coding, c)
+		}
+	}
+}
+
+func TestReadGtfExtraFields(t *testing.T) {
+	gtf := []byte(`chr1	HAVANA	gene	101	1000	.	+	.	gene_id "g1";	extra
+chr1	HAVANA	exon	101	400	.	+	.	gene_id "g1"; transcript_id "t1";	extra
+`)
+	s := NewScanner(bytes.NewReader(gtf), map[string]int{"chr1": 2000})
+	if s.r.format != GTF {
+		t.Fatalf("(ReadGtf) expected GTF format, got %v", s.r.format)
+	}
+	var n int
+	for s.Next() {
+		n++
+	}
+	if err := s.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Error("(ReadGtf) no features read from lines with extra fields")
+	}
+}
+
+func TestReadBedBlocks(t *testing.T) {
+	bed := []byte(`track name=test
+chr1	100	1000	tx1	0	-	200	800	0	3	100,200,200,	0,300,700,
+chr1	1500	1600	tx2	0	+
+`)
+	expected := []string{
+		"chr1:0-100:intergenic:.",
+		"chr1:100-1000:gene:-",
+		"chr1:100-200:exon:-",
+		"chr1:100-200:three_prime_utr:-",
+		"chr1:200-400:intron:.",
+		"chr1:400-600:CDS:-",
+		"chr1:400-600:exon:-",
+		"chr1:600-800:intron:.",
+		"chr1:800-1000:exon:-",
+		"chr1:800-1000:five_prime_utr:-",
+		"chr1:1000-1500:intergenic:.",
+		"chr1:1500-1600:exon:+",
+		"chr1:1500-1600:gene:+",
+		"chr1:1600-2000:intergenic:.",
+	}
+	s := NewScanner(bytes.NewReader(bed), map[string]int{"chr1": 2000})
+	if s.r.format != BED {
+		t.Fatalf("(TestReadBedBlocks) expected BED format, got %s", s.r.format)
+	}
+	m, err := createIndex(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, f := range QueryIndex(m.Get("chr1"), 0, 2000) {
+		f := f.(*Feature)
+		res = append(res, fmt.Sprintf("%s:%s", f, f.Strand()))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		var si, sj float64
+		fmt.Sscanf(strings.Split(res[i], ":")[1], "%f", &si)
+		fmt.Sscanf(strings.Split(res[j], ":")[1], "%f", &sj)
+		if si != sj {
+			return si < sj
+		}
+		return res[i] < res[j]
+	})
+	if strings.Join(res, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("(TestReadBedBlocks) index elements error.\ngot:\n%s\nexp:\n%s", strings.Join(res, "\n"), strings.Join(expected, "\n"))
+	}
+
+	for _, c := range []struct {
+		record string
+		err    string
+	}{
+		{"chr1\t100\t200\n", "line 1: expected at least 4 fields, got 3"},
+		{"chr1\t100\t1000\ttx1\t0\t+\t100\t1000\t0\t2\t100,\t0,\n", "line 1: expected 2 block sizes and starts, got 1 and 1"},
+		{"chr1\t100\t1000\ttx1\t0\t+\t100\t1000\t0\t1\t1000,\t0,\n", "line 1: block 100-1100 outside record 100-1000"},
+	} {
+		s := NewScanner(strings.NewReader(c.record), nil)
+		s.r.format = BED
+		for s.Next() {
+		}
+		if s.Error() == nil || s.Error().Error() != c.err {
+			t.Errorf("(TestReadBedBlocks) expected error %q, got %v", c.err, s.Error())
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package annotation
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	mitochondrialNames = []string{"chrM", "chrMT", "MT", "M"}
+)
+
+// ChrMapper maps the chromosome names of an annotation onto the reference names of a BAM file.
+// Names are matched exactly, then using the user supplied aliases and finally adding or removing
+// the "chr" prefix. Mitochondrial chromosome names (chrM, chrMT, MT, M) are reconciled too.
+type ChrMapper struct {
+	chrLens   map[string]int
+	aliases   map[string]string
+	mapped    map[string]string
+	unmatched map[string]int
+}
+
+// NewChrMapper returns a new instance of ChrMapper for the given BAM references lengths and aliases.
+func NewChrMapper(chrLens map[string]int, aliases map[string]string) *ChrMapper {
+	m := &ChrMapper{
+		chrLens:   chrLens,
+		aliases:   make(map[string]string),
+		mapped:    make(map[string]string),
+		unmatched: make(map[string]int),
+	}
+	for k, v := range aliases {
+		m.aliases[k] = v
+		if _, ok := aliases[v]; !ok {
+			m.aliases[v] = k
+		}
+	}
+	return m
+}
+
+// Map returns the BAM reference name matching chr and true, or false if the chromosome
+// cannot be found in the BAM header. If no BAM references are available chr is returned as is.
+func (m *ChrMapper) Map(chr string) (string, bool) {
+	if name, ok := m.mapped[chr]; ok {
+		return name, true
+	}
+	if _, ok := m.unmatched[chr]; ok {
+		m.unmatched[chr]++
+		return "", false
+	}
+	name, ok := m.match(chr)
+	if !ok {
+		m.unmatched[chr]++
+		return "", false
+	}
+	m.mapped[chr] = name
+	return name, true
+}
+
+func (m *ChrMapper) match(chr string) (string, bool) {
+	if len(m.chrLens) == 0 || m.has(chr) {
+		return chr, true
+	}
+	if alias, ok := m.aliases[chr]; ok && m.has(alias) {
+		return alias, true
+	}
+	if strings.HasPrefix(chr, "chr") {
+		if m.has(chr[3:]) {
+			return chr[3:], true
+		}
+	} else if m.has("chr" + chr) {
+		return "chr" + chr, true
+	}
+	if isMitochondrial(chr) {
+		for _, name := range mitochondrialNames {
+			if m.has(name) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (m *ChrMapper) has(chr string) bool {
+	_, ok := m.chrLens[chr]
+	return ok
+}
+
+// Len returns the length of a BAM reference.
+func (m *ChrMapper) Len(chr string) int {
+	return m.chrLens[chr]
+}
+
+// Unmatched returns the sorted list of chromosomes that could not be found in the BAM header.
+func (m *ChrMapper) Unmatched() []string {
+	var chrs []string
+	for chr := range m.unmatched {
+		chrs = append(chrs, chr)
+	}
+	sort.Strings(chrs)
+	return chrs
+}
+
+// UnmatchedString returns a string representation of the unmatched chromosomes along with their number of features.
+func (m *ChrMapper) UnmatchedString() string {
+	var s []string
+	for _, chr := range m.Unmatched() {
+		s = append(s, fmt.Sprintf("%s (%d)", chr, m.unmatched[chr]))
+	}
+	return strings.Join(s, ", ")
+}
+
+func isMitochondrial(chr string) bool {
+	for _, name := range mitochondrialNames {
+		if chr == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadChrAliases reads a chromosome aliases file. Each line of the file contains the annotation
+// and the BAM names of a chromosome separated by whitespaces. Lines starting with '#' are ignored.
+func ReadChrAliases(fileName string) (map[string]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readChrAliases(f)
+}
+
+func readChrAliases(r io.Reader) (map[string]string, error) {
+	aliases := make(map[string]string)
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		l := bytes.TrimSpace(s.Bytes())
+		if skip(l) {
+			continue
+		}
+		fields := bytes.Fields(l)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("chromosome aliases, line %d: expected 2 fields, got %d", line, len(fields))
+		}
+		aliases[string(fields[0])] = string(fields[1])
+	}
+	return aliases, s.Err()
+}
@@ -0,0 +1,179 @@
+package annotation
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/dhconnelly/rtreego"
+)
+
+// elementsOrder is the order of the derived elements starting at the same position
+var elementsOrder = map[string]int{
+	"gene":       0,
+	"exon":       1,
+	"intron":     2,
+	"intergenic": 3,
+}
+
+// Elements returns the genomic elements derived from the index, sorted by position: the annotated
+// genes, the merged exons, the introns and the intergenic regions. Merged exons and introns carry
+// the gene ids, biotypes and strands of the overlapping genes, joined by commas when more than one.
+// Chromosomes in chrLens without annotated features are a single intergenic region.
+func Elements(index *RtreeMap, chrLens map[string]int, biotypeTag string) FeatureSlice {
+	var elements FeatureSlice
+	for _, t := range *index {
+		genes := QueryIndexByElement(t, 0, math.MaxFloat64, "gene")
+		for _, g := range NewFeatureSlice(genes) {
+			elements = append(elements, geneFeature(g, biotypeTag))
+		}
+		for _, e := range mergeFeatures(QueryIndexByElement(t, 0, math.MaxFloat64, "exon"), biotypeTag) {
+			elements = append(elements, e)
+		}
+		for _, i := range NewFeatureSlice(QueryIndexByElement(t, 0, math.MaxFloat64, "intron")) {
+			n, _ := parseFeature(i.chr, i.element, i.Start(), i.End())
+			var overlapping []*Feature
+			for _, g := range NewFeatureSlice(QueryIndexByElement(t, i.Start(), i.End(), "gene")) {
+				if g.Start() < i.End() && g.End() > i.Start() {
+					overlapping = append(overlapping, g)
+				}
+			}
+			setGeneTags(n, overlapping, biotypeTag)
+			elements = append(elements, n)
+		}
+		for _, i := range NewFeatureSlice(QueryIndexByElement(t, 0, math.MaxFloat64, "intergenic")) {
+			n, _ := parseFeature(i.chr, i.element, i.Start(), i.End())
+			elements = append(elements, n)
+		}
+	}
+	for chr, l := range chrLens {
+		if t := index.Get(chr); t != nil && t.Size() > 0 {
+			continue
+		}
+		n, _ := parseFeature([]byte(chr), []byte("intergenic"), 0, float64(l))
+		elements = append(elements, n)
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		if elements.Less(i, j) {
+			return true
+		}
+		if elements.Less(j, i) {
+			return false
+		}
+		return elementsOrder[elements[i].Element()] < elementsOrder[elements[j].Element()]
+	})
+	return elements
+}
+
+// geneFeature returns a copy of a gene keeping only the gene id and biotype tags
+func geneFeature(g *Feature, biotypeTag string) *Feature {
+	n, _ := parseFeature(g.chr, g.element, g.Start(), g.End())
+	setGeneTags(n, []*Feature{g}, biotypeTag)
+	return n
+}
+
+// mergeFeatures merges overlapping features, without modifying them, into new features
+// having the tags of all the merged features.
+func mergeFeatures(in []rtreego.Spatial, biotypeTag string) []*Feature {
+	features := NewFeatureSlice(in)
+	sort.Sort(features)
+	var out []*Feature
+	var group []*Feature
+	var end float64
+	flush := func() {
+		if len(group) == 0 {
+			return
+		}
+		n, _ := parseFeature(group[0].chr, group[0].element, group[0].Start(), end)
+		setGeneTags(n, group, biotypeTag)
+		out = append(out, n)
+	}
+	for _, f := range features {
+		if len(group) > 0 && f.Start() > end {
+			flush()
+			group = nil
+		}
+		if len(group) == 0 || f.End() > end {
+			end = f.End()
+		}
+		group = append(group, f)
+	}
+	flush()
+	return out
+}
+
+// setGeneTags sets the gene id and biotype tags and the strand of f from the given features
+func setGeneTags(f *Feature, from []*Feature, biotypeTag string) {
+	ids := distinct(from, func(g *Feature) string { return g.Tag("gene_id") })
+	biotypes := distinct(from, func(g *Feature) string { return g.Tag(biotypeTag) })
+	strands := distinct(from, func(g *Feature) string { return g.Strand() })
+	tags := make(map[string][]byte)
+	if len(ids) > 0 {
+		tags["gene_id"] = []byte(strings.Join(ids, ","))
+	}
+	if len(biotypes) > 0 {
+		tags[biotypeTag] = []byte(strings.Join(biotypes, ","))
+	}
+	f.SetTags(tags)
+	if len(strands) == 1 {
+		f.SetStrand([]byte(strands[0]))
+	}
+}
+
+func distinct(features []*Feature, value func(*Feature) string) []string {
+	seen := make(map[string]struct{})
+	var values []string
+	for _, f := range features {
+		v := value(f)
+		if _, ok := seen[v]; ok || v == "" {
+			continue
+		}
+		seen[v] = struct{}{}
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// WriteElements writes the elements derived from the index to w in the specified format. BED
+// output is BED6+2: six columns, with the element type as name, followed by the gene id and
+// biotype columns. GTF output has the gene id and the biotype, using biotypeTag, as attributes.
+// Chromosomes in chrLens without annotated features are written as a single intergenic element.
+func WriteElements(out io.Writer, index *RtreeMap, chrLens map[string]int, format Format, biotypeTag string) error {
+	w := bufio.NewWriter(out)
+	for _, f := range Elements(index, chrLens, biotypeTag) {
+		var err error
+		switch format {
+		case BED:
+			_, err = fmt.Fprintf(w, "%s\t%.0f\t%.0f\t%s\t0\t%s\t%s\t%s\n", f.Chr(), f.Start(), f.End(), f.Element(), f.Strand(), dot(f.Tag("gene_id")), dot(f.Tag(biotypeTag)))
+		case GTF:
+			_, err = fmt.Fprintf(w, "%s\tbamstats\t%s\t%.0f\t%.0f\t.\t%s\t.\t%s\n", f.Chr(), f.Element(), f.Start()+1, f.End(), f.Strand(), gtfAttributes(f, biotypeTag))
+		default:
+			err = fmt.Errorf("WriteElements, %s format error", format)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func dot(s string) string {
+	if s == "" {
+		return "."
+	}
+	return s
+}
+
+func gtfAttributes(f *Feature, biotypeTag string) string {
+	var attrs []string
+	for _, k := range []string{"gene_id", biotypeTag} {
+		if v := f.Tag(k); v != "" {
+			attrs = append(attrs, fmt.Sprintf("%s \"%s\";", k, v))
+		}
+	}
+	return dot(strings.Join(attrs, " "))
+}
@@ -71,9 +71,9 @@ func NewFeatureSlice(intervals []rtreego.Spatial) FeatureSlice {
 
 // Feature represents an annotated element.
 type Feature struct {
-	location     *rtreego.Rect
-	chr, element []byte
-	tags         map[string][]byte
+	location             *rtreego.Rect
+	chr, element, strand []byte
+	tags                 map[string][]byte
 }
 
 // Chr returns the chromosome of the feature
@@ -96,6 +96,14 @@ func (f *Feature) Element() string {
 	return string(f.element)
 }
 
+// Strand returns the strand of the feature, or "." if unknown
+func (f *Feature) Strand() string {
+	if len(f.strand) == 0 {
+		return "."
+	}
+	return string(f.strand)
+}
+
 // Bounds returns the location of the feature. It is used within the Rtree.
 func (f *Feature) Bounds() *rtreego.Rect {
 	return f.location
@@ -106,6 +114,11 @@ func (f *Feature) SetBounds(newLocation *rtreego.Rect) {
 	f.location = newLocation
 }
 
+// SetStrand set the feature strand
+func (f *Feature) SetStrand(strand []byte) {
+	f.strand = strand
+}
+
 // SetTags set feture tags
 func (f *Feature) SetTags(tags map[string][]byte) {
 	f.tags = tags
@@ -138,5 +151,6 @@ func NewFeature(chr []byte, element []byte, rect *rtreego.Rect) *Feature {
 		chr,
 		element,
 		nil,
+		nil,
 	}
 }
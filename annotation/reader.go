@@ -6,9 +6,11 @@ import (
 	"compress/bzip2"
 	"compress/gzip"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"sort"
 	"strconv"
 	"unsafe"
 
@@ -19,23 +21,73 @@ const (
 	peekLen = 4096
 )
 
+// gtfElements contains the GTF feature types loaded into the index
+var gtfElements = map[string]struct{}{
+	"gene":            {},
+	"exon":            {},
+	"CDS":             {},
+	"UTR":             {},
+	"five_prime_utr":  {},
+	"three_prime_utr": {},
+	"start_codon":     {},
+	"stop_codon":      {},
+}
+
+// derivedElements contains the elements derived from genes and exons when creating the index
+var derivedElements = map[string]struct{}{
+	"intron":     {},
+	"intergenic": {},
+}
+
+// ParseError represents an error found while parsing a line of an annotation file
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+// Error returns the string representation of a ParseError
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
 // FeatureReader is a struct for readinf features
 type FeatureReader struct {
 	r            *bufio.Reader
 	format       Format
 	exons, genes [3]*Feature
 	line         int
-	chrLens      map[string]int
+	chrs         *ChrMapper
+	biotypeTag   string
+	pending      FeatureSlice
+	err          error
+	// strict reports GTF lines with more than 9 fields in warnings, which are read otherwise
+	strict   bool
+	warnings []*ParseError
 }
 
 // NewFeatureReader returns a new instance of FeatureReader
 func NewFeatureReader(r io.Reader, chrs map[string]int) *FeatureReader {
-	br := buffReader(r)
-	format := scanFormat(br, peekLen)
-	return &FeatureReader{
-		r:       br,
-		format:  format,
-		chrLens: chrs,
+	fr := &FeatureReader{
+		chrs:       NewChrMapper(chrs, nil),
+		biotypeTag: "gene_type",
+	}
+	fr.r, fr.err = buffReader(r)
+	if fr.err == nil {
+		fr.format, fr.err = scanFormat(fr.r, peekLen)
+	}
+	return fr
+}
+
+// SetChrAliases sets the aliases used for matching annotation chromosomes with BAM references.
+func (r *FeatureReader) SetChrAliases(aliases map[string]string) {
+	r.chrs = NewChrMapper(r.chrs.chrLens, aliases)
+}
+
+// SetBiotypeTag sets the attribute used for the gene biotypes read from BED files written
+// by WriteElements. The default gene_type attribute is kept if biotypeTag is empty.
+func (r *FeatureReader) SetBiotypeTag(biotypeTag string) {
+	if biotypeTag != "" {
+		r.biotypeTag = biotypeTag
 	}
 }
 
@@ -63,25 +115,25 @@ func isBzip2(b *bufio.Reader) (bool, error) {
 	return CheckBytes(b, []byte{0x42, 0x5a})
 }
 
-func buffReader(r io.Reader) *bufio.Reader {
+func buffReader(r io.Reader) (*bufio.Reader, error) {
 
 	br := bufio.NewReader(r)
-	if isGz, err := isGzip(br); err != nil {
-		log.Fatal(err)
+	if isGz, err := isGzip(br); err != nil && err != io.EOF {
+		return nil, err
 	} else if isGz {
 		rdr, err := gzip.NewReader(br)
 		if err != nil {
-			return nil
+			return nil, err
 		}
 		br = bufio.NewReader(rdr)
-	} else if isBz, err := isBzip2(br); err != nil {
-		log.Fatal(err)
+	} else if isBz, err := isBzip2(br); err != nil && err != io.EOF {
+		return nil, err
 	} else if isBz {
 		rdr := bzip2.NewReader(br)
 		br = bufio.NewReader(rdr)
 	}
 
-	return br
+	return br, nil
 }
 
 func isTab(r rune) bool {
@@ -92,34 +144,40 @@ func isNewLine(r rune) bool {
 	return r == '\n'
 }
 
-func scanFormat(r *bufio.Reader, n int) (format Format) {
+func scanFormat(r *bufio.Reader, n int) (format Format, err error) {
 	b, err := r.Peek(n)
 	if err != nil {
 		if err != io.EOF {
-			panic(err)
+			return UNDEF, err
 		}
 	}
 	lines := bytes.FieldsFunc(b, isNewLine)
 scan:
 	for i, line := range lines {
-		if line[0] == '#' {
+		if line[0] == '#' || isBedHeader(line) {
 			continue
 		}
-		if i == len(lines)-1 && !isNewLine(rune(line[len(line)-1])) {
-			log.Fatal("Cannot guess type. Try increasing the peek buffer.")
+		if i == len(lines)-1 && err == nil && !isNewLine(rune(b[len(b)-1])) {
+			return UNDEF, errors.New("cannot guess the annotation format: line longer than the peek buffer")
 		}
-		switch c := bytes.Count(line, []byte{'\t'}); c + 1 {
-		case 4:
-			format = BED
-			break scan
-		case 9:
+		fields := bytes.Split(bytes.TrimSpace(line), []byte{'\t'})
+		switch {
+		case len(fields) >= 9 && isNumber(fields[3]) && isNumber(fields[4]) && !isNumber(fields[1]):
 			format = GTF
 			break scan
+		case len(fields) >= 4 && isNumber(fields[1]) && isNumber(fields[2]):
+			format = BED
+			break scan
 		default:
 			format = UNDEF
 		}
 	}
-	return
+	return format, nil
+}
+
+func isNumber(b []byte) bool {
+	_, err := strconv.Atoi(unsafeString(b))
+	return err == nil
 }
 
 // This function cannot be used to create strings that are expected to persist.
@@ -128,6 +186,9 @@ func unsafeString(b []byte) string {
 }
 
 func (r *FeatureReader) Read() (f *Feature, err error) {
+	if r.err != nil {
+		return nil, r.err
+	}
 	switch r.format {
 	case BED:
 		f, err = readBed(r)
@@ -186,10 +247,16 @@ func parseTags(b []byte) map[string][]byte {
 }
 
 func readBed(r *FeatureReader) (f *Feature, err error) {
+	if len(r.pending) > 0 {
+		f, r.pending = r.pending[0], r.pending[1:]
+		return f, nil
+	}
 	var line []byte
+	var fields [][]byte
+	var chr string
 	for {
 		line, err = r.r.ReadBytes('\n')
-		//r.line++
+		r.line++
 		if err != nil {
 			if err == io.EOF {
 				return f, err
@@ -197,21 +264,138 @@ func readBed(r *FeatureReader) (f *Feature, err error) {
 			return nil, &csv.ParseError{Err: err}
 		}
 		line = bytes.TrimSpace(line)
-		if skip(line) { // ignore blank lines and comment lines
+		if skip(line) || isBedHeader(line) { // ignore blank, comment and header lines
 			continue
-		} else {
+		}
+		fields = bytes.Split(line, []byte{'\t'})
+		if len(fields) < 4 {
+			return nil, &ParseError{r.line, fmt.Errorf("expected at least 4 fields, got %d", len(fields))}
+		}
+		var ok bool
+		if chr, ok = r.chrs.Map(string(fields[0])); ok {
 			break
 		}
 	}
-	fields := bytes.Split(line, []byte{'\t'})
-	chr := fields[0]
 	start := fields[1]
 	end := fields[2]
-	element := fields[3]
+	name := fields[3]
 
 	s, e := parseInterval(start, end)
+	if s < 0 || e <= s {
+		return nil, &ParseError{r.line, fmt.Errorf("invalid coordinates %s-%s", start, end)}
+	}
+
+	if len(fields) < 6 {
+		return parseFeature([]byte(chr), name, s, e)
+	}
+	strand := fields[5]
+	if len(fields) >= 12 {
+		r.pending, err = parseBlocks([]byte(chr), fields, s, e)
+		if err != nil {
+			return nil, &ParseError{r.line, err}
+		}
+		f, r.pending = r.pending[0], r.pending[1:]
+		return f, nil
+	}
+	tags := make(map[string][]byte)
+	element := name
+	if !isElement(name) {
+		// single block transcript
+		element = []byte("exon")
+		tags["gene_id"] = name
+		tags["transcript_id"] = name
+	} else if len(fields) >= 8 {
+		// elements written by WriteElements
+		for k, v := range map[string][]byte{"gene_id": fields[6], r.biotypeTag: fields[7]} {
+			if !bytes.Equal(v, []byte{'.'}) {
+				tags[k] = v
+			}
+		}
+	}
+	f, err = parseFeature([]byte(chr), element, s, e)
+	if err != nil {
+		return nil, &ParseError{r.line, err}
+	}
+	f.SetStrand(strand)
+	f.SetTags(tags)
+	return f, nil
+}
+
+// parseBlocks returns the exons of a BED12 transcript record, along with the CDS and UTRs
+// if thickStart and thickEnd define a coding region. Features are sorted by start position.
+// The record name is used as both transcript and gene id.
+func parseBlocks(chr []byte, fields [][]byte, start, end float64) (FeatureSlice, error) {
+	name := fields[3]
+	strand := fields[5]
+	thickStart, thickEnd := parseInterval(fields[6], fields[7])
+	if thickStart < 0 || thickEnd < thickStart {
+		return nil, fmt.Errorf("invalid thick coordinates %s-%s", fields[6], fields[7])
+	}
+	count, err := strconv.Atoi(unsafeString(fields[9]))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid block count %s", fields[9])
+	}
+	sizes := bytes.Split(bytes.TrimSuffix(fields[10], []byte{','}), []byte{','})
+	starts := bytes.Split(bytes.TrimSuffix(fields[11], []byte{','}), []byte{','})
+	if len(sizes) != count || len(starts) != count {
+		return nil, fmt.Errorf("expected %d block sizes and starts, got %d and %d", count, len(sizes), len(starts))
+	}
+	tags := map[string][]byte{
+		"gene_id":       name,
+		"transcript_id": name,
+	}
+	var features FeatureSlice
+	add := func(element string, s, e float64) error {
+		if e <= s {
+			return nil
+		}
+		f, err := parseFeature(chr, []byte(element), s, e)
+		if err != nil {
+			return err
+		}
+		f.SetStrand(strand)
+		f.SetTags(tags)
+		features = append(features, f)
+		return nil
+	}
+	for i := range sizes {
+		bs, be := parseInterval(starts[i], sizes[i])
+		if bs < 0 || be <= 0 {
+			return nil, fmt.Errorf("invalid block %s,%s", starts[i], sizes[i])
+		}
+		bs += start
+		be += bs
+		if be > end {
+			return nil, fmt.Errorf("block %.0f-%.0f outside record %.0f-%.0f", bs, be, start, end)
+		}
+		if err := add("exon", bs, be); err != nil {
+			return nil, err
+		}
+		if thickEnd > thickStart {
+			if err := add("UTR", bs, math.Min(be, thickStart)); err != nil {
+				return nil, err
+			}
+			if err := add("CDS", math.Max(bs, thickStart), math.Min(be, thickEnd)); err != nil {
+				return nil, err
+			}
+			if err := add("UTR", math.Max(bs, thickEnd), be); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Stable(features)
+	return features, nil
+}
+
+// isElement returns true if name is an element type rather than a transcript name
+func isElement(name []byte) bool {
+	_, isGtf := gtfElements[string(name)]
+	_, isDerived := derivedElements[string(name)]
+	return isGtf || isDerived
+}
 
-	return parseFeature(chr, element, s, e)
+func isBedHeader(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("track")) || bytes.HasPrefix(line, []byte("browser"))
 }
 
 func readGtf(r *FeatureReader) (f *Feature, err error) {
@@ -220,7 +404,7 @@ func readGtf(r *FeatureReader) (f *Feature, err error) {
 	var element []byte
 	for {
 		line, err = r.r.ReadBytes('\n')
-		//r.line++
+		r.line++
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -232,20 +416,32 @@ func readGtf(r *FeatureReader) (f *Feature, err error) {
 			continue
 		} else {
 			fields = bytes.Split(line, []byte{'\t'})
-			elem := string(fields[2])
-			if elem != "gene" && elem != "exon" {
+			if len(fields) < 9 {
+				return nil, &ParseError{r.line, fmt.Errorf("expected 9 fields, got %d", len(fields))}
+			}
+			if r.strict && len(fields) > 9 {
+				r.warnings = append(r.warnings, &ParseError{r.line, fmt.Errorf("expected 9 fields, got %d", len(fields))})
+			}
+			if _, ok := gtfElements[string(fields[2])]; !ok {
 				continue
 			}
 			element = fields[2]
-			chr := fields[0]
+			chr, ok := r.chrs.Map(string(fields[0]))
+			if !ok {
+				continue
+			}
 			start := fields[3]
 			end := fields[4]
 			tags := parseTags(fields[8])
-			if _, ok := r.chrLens[string(chr)]; !ok {
-				continue
-			}
 			s, e := parseInterval(start, end)
-			f, err = parseFeature(chr, element, s-1, e)
+			if s < 1 || e < s {
+				return nil, &ParseError{r.line, fmt.Errorf("invalid coordinates %s-%s", start, end)}
+			}
+			f, err = parseFeature([]byte(chr), element, s-1, e)
+			if err != nil {
+				return nil, &ParseError{r.line, err}
+			}
+			f.SetStrand(fields[6])
 			f.SetTags(tags)
 			break
 		}
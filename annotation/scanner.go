@@ -16,6 +16,16 @@ func NewScanner(r io.Reader, chrs map[string]int) *Scanner {
 	}
 }
 
+// SetChrAliases sets the aliases used for matching annotation chromosomes with BAM references.
+func (s *Scanner) SetChrAliases(aliases map[string]string) {
+	s.r.SetChrAliases(aliases)
+}
+
+// SetBiotypeTag sets the attribute used for the gene biotypes read from BED files written by WriteElements.
+func (s *Scanner) SetBiotypeTag(biotypeTag string) {
+	s.r.SetBiotypeTag(biotypeTag)
+}
+
 // Next reads the next feature
 func (s *Scanner) Next() bool {
 	if s.err != nil {
@@ -33,6 +43,11 @@ func (s *Scanner) Error() error {
 	return s.err
 }
 
+// Line returns the line number of the current read feature
+func (s *Scanner) Line() int {
+	return s.r.line
+}
+
 // Feat returns the current read feature
 func (s *Scanner) Feat() *Feature {
 	return s.feat
@@ -0,0 +1,154 @@
+package annotation
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+type span struct {
+	chr        string
+	start, end float64
+	line       int
+}
+
+// validator collects the problems found while scanning an annotation file
+type validator struct {
+	format    Format
+	chrs      *ChrMapper
+	problems  []*ParseError
+	chrOrder  map[string]int
+	lastChr   string
+	lastStart float64
+	lastLine  int
+	seenGenes map[string]struct{}
+	unsorted  map[string]struct{}
+	genes     map[string]span
+	exons     map[string][]span
+	unknown   map[string]int
+}
+
+func newValidator(format Format, chrs *ChrMapper) *validator {
+	return &validator{
+		format:    format,
+		chrs:      chrs,
+		chrOrder:  make(map[string]int),
+		seenGenes: make(map[string]struct{}),
+		unsorted:  make(map[string]struct{}),
+		genes:     make(map[string]span),
+		exons:     make(map[string][]span),
+		unknown:   make(map[string]int),
+	}
+}
+
+func (v *validator) add(line int, format string, a ...interface{}) {
+	v.problems = append(v.problems, &ParseError{line, fmt.Errorf(format, a...)})
+}
+
+func (v *validator) check(f *Feature, line int) {
+	chr := f.Chr()
+	if _, ok := v.chrs.Map(chr); !ok {
+		if _, seen := v.unknown[chr]; !seen {
+			v.unknown[chr] = line
+		}
+	}
+	v.checkOrder(f, line)
+	if v.format != GTF {
+		return
+	}
+	geneID := f.Tag("gene_id")
+	if geneID == "" {
+		v.add(line, "missing gene_id attribute")
+		return
+	}
+	s := span{chr, f.Start(), f.End(), line}
+	switch f.Element() {
+	case "gene":
+		v.genes[geneID] = s
+	case "exon":
+		v.exons[geneID] = append(v.exons[geneID], s)
+	}
+}
+
+// checkOrder checks that chromosomes are not interleaved and that genes, or records
+// for BED files, are sorted by start position within each chromosome. Only the first
+// unsorted feature of each chromosome is reported.
+func (v *validator) checkOrder(f *Feature, line int) {
+	if line == v.lastLine {
+		// features from the blocks of a BED12 record
+		return
+	}
+	v.lastLine = line
+	chr := f.Chr()
+	if chr != v.lastChr {
+		if l, seen := v.chrOrder[chr]; seen {
+			v.add(line, "unsorted input: chromosome %s already found at line %d", chr, l)
+		} else {
+			v.chrOrder[chr] = line
+		}
+		v.lastChr = chr
+		v.lastStart = 0
+	}
+	if v.format == GTF {
+		geneID := f.Tag("gene_id")
+		if _, seen := v.seenGenes[geneID]; seen || geneID == "" {
+			return
+		}
+		v.seenGenes[geneID] = struct{}{}
+	}
+	if _, seen := v.unsorted[chr]; !seen && f.Start() < v.lastStart {
+		v.add(line, "unsorted input: %s starts before the previous feature", f)
+		v.unsorted[chr] = struct{}{}
+	}
+	v.lastStart = f.Start()
+}
+
+func (v *validator) finalize() []*ParseError {
+	for geneID, exons := range v.exons {
+		g, ok := v.genes[geneID]
+		if !ok {
+			continue
+		}
+		for _, e := range exons {
+			if e.chr != g.chr || e.start < g.start || e.end > g.end {
+				v.add(e.line, "exon %s:%.0f-%.0f outside gene %s %s:%.0f-%.0f (line %d)", e.chr, e.start+1, e.end, geneID, g.chr, g.start+1, g.end, g.line)
+			}
+		}
+	}
+	for chr, line := range v.unknown {
+		v.add(line, "chromosome %s not found in the BAM header", chr)
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].Line < v.problems[j].Line
+	})
+	return v.problems
+}
+
+// Validate checks the annotation read from r and returns the problems found, sorted by line number.
+// Lines with bad coordinates, missing gene_id attributes, exons outside their gene and unsorted
+// features are reported, as well as GTF lines with more than 9 fields, which are read otherwise. If chrLens is not empty, chromosomes not found in the BAM references,
+// after applying the aliases, are reported too. An error is returned if the annotation cannot be read.
+func Validate(r io.Reader, chrLens map[string]int, aliases map[string]string) ([]*ParseError, error) {
+	s := NewScanner(r, nil)
+	s.r.strict = true
+	v := newValidator(s.r.format, NewChrMapper(chrLens, aliases))
+	for {
+		if s.Next() {
+			if f := s.Feat(); f != nil {
+				v.check(f, s.Line())
+			}
+			continue
+		}
+		if perr, ok := s.err.(*ParseError); ok {
+			v.problems = append(v.problems, perr)
+			s.err = nil
+			continue
+		}
+		break
+	}
+	if err := s.Error(); err != nil {
+		return nil, err
+	}
+	v.problems = append(v.problems, s.r.warnings...)
+	return v.finalize(), nil
+}
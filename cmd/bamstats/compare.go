@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/guigolab/bamstats/stats"
+	"github.com/guigolab/bamstats/utils"
+	"github.com/spf13/cobra"
+)
+
+var tolerances []string
+
+func formatValue(v float64, ok bool) string {
+	if !ok {
+		return "NA"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func compare(cmd *cobra.Command, args []string) error {
+	var tols []*stats.Tolerance
+	for _, s := range tolerances {
+		t, err := stats.ParseTolerance(s)
+		if err != nil {
+			return err
+		}
+		tols = append(tols, t)
+	}
+	a, err := readStatsFile(args[0])
+	if err != nil {
+		return err
+	}
+	b, err := readStatsFile(args[1])
+	if err != nil {
+		return err
+	}
+	diffs, err := stats.Compare(a, b, tols)
+	if err != nil {
+		return err
+	}
+	w := utils.NewWriter(output)
+	if w == nil {
+		return fmt.Errorf("cannot create output file %s", output)
+	}
+	fmt.Fprintln(w, strings.Join([]string{"path", "a", "b", "abs_diff", "rel_diff", "tolerance", "status"}, "\t"))
+	failed := 0
+	for _, d := range diffs {
+		abs, rel := "NA", "NA"
+		if d.InA && d.InB {
+			abs, rel = fmt.Sprintf("%g", d.Abs()), fmt.Sprintf("%g", d.Rel())
+		}
+		tol := ""
+		if d.Tolerance != nil {
+			tol = d.Tolerance.String()
+		}
+		if d.Exceeds() {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.Path, formatValue(d.A, d.InA), formatValue(d.B, d.InB), abs, rel, tol, d.Status())
+	}
+	if err := utils.Flush(w); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return withCode(exitFailed, fmt.Errorf("%d statistics exceed their tolerance", failed))
+	}
+	return nil
+}
+
+func newCompareCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "compare a.json b.json",
+		Short: "Compare two bamstats JSON files",
+		Long: `Report the absolute and relative differences of all the statistics of two bamstats JSON files.
+The share of each statistic in the total of its group is reported too, e.g. coverage.total.exon_share.
+Tolerances are given as path=value for absolute differences or path=value% for relative differences,
+paths possibly containing wildcards (e.g. 'coverage.*.exon_share=1%'). The command fails if any
+difference exceeds its tolerance.`,
+		Args:         cobra.ExactArgs(2),
+		RunE:         compare,
+		SilenceUsage: true,
+	}
+	c.Flags().StringArrayVarP(&tolerances, "tolerance", "t", nil, "maximum allowed difference as path=value or path=value% (can be repeated)")
+	c.Flags().StringVarP(&output, "output", "o", "-", "output file")
+	return c
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/guigolab/bamstats"
+	anno "github.com/guigolab/bamstats/annotation"
+	"github.com/guigolab/bamstats/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var elementsFormat string
+
+func elements(cmd *cobra.Command, args []string) error {
+	var format anno.Format
+	switch strings.ToLower(elementsFormat) {
+	case "bed":
+		format = anno.BED
+	case "gtf":
+		format = anno.GTF
+	default:
+		return withCode(exitUsage, fmt.Errorf("invalid elements format: %s", elementsFormat))
+	}
+	chrLens := bamstats.ChrLens(bam)
+	if chrLens == nil {
+		return fmt.Errorf("cannot read the BAM header of %s", bam)
+	}
+	var aliases map[string]string
+	if chrAliases != "" {
+		var err error
+		aliases, err = anno.ReadChrAliases(chrAliases)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Creating index for %s", annotation)
+	index, err := anno.CreateIndexWithOptions(annotation, chrLens, anno.IndexOptions{
+		ChrAliases: aliases,
+		BiotypeTag: biotypeTag,
+	})
+	if err != nil {
+		return err
+	}
+	w := utils.NewWriter(output)
+	if w == nil {
+		return fmt.Errorf("cannot create output file %s", output)
+	}
+	if err := anno.WriteElements(w, index, chrLens, format, biotypeTag); err != nil {
+		return err
+	}
+	return utils.Flush(w)
+}
+
+func newElementsCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:          "elements",
+		Short:        "Write the genomic elements derived from an annotation",
+		Long:         "Write the genes, merged exons, introns and intergenic regions derived from an annotation file, along with gene ids and biotypes, as BED6+2 (BED6 followed by gene id and biotype columns) or GTF",
+		RunE:         elements,
+		SilenceUsage: true,
+	}
+	c.Flags().StringVarP(&annotation, "annotaion", "a", "", "element annotation file (required)")
+	c.Flags().StringVarP(&bam, "input", "i", "", "BAM file whose header provides the chromosome lengths (required)")
+	c.Flags().StringVarP(&chrAliases, "chr-aliases", "", "", "file with annotation and BAM chromosome name pairs, one per line")
+	c.Flags().StringVarP(&biotypeTag, "biotype-tag", "", "gene_type", "annotation attribute containing the gene biotype (e.g. gene_biotype for Ensembl)")
+	c.Flags().StringVarP(&elementsFormat, "format", "f", "bed", "output format (bed|gtf), bed being BED6+2")
+	c.Flags().StringVarP(&output, "output", "o", "-", "output file")
+	c.MarkFlagRequired("annotaion")
+	c.MarkFlagRequired("input")
+	return c
+}
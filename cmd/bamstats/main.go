@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/guigolab/bamstats"
+	"github.com/guigolab/bamstats/config"
+	"github.com/guigolab/bamstats/sam"
+	"github.com/guigolab/bamstats/stats"
 	"github.com/guigolab/bamstats/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var (
@@ -18,19 +26,91 @@ var (
 
 var (
 	bam, annotation, loglevel, output string
+	configFile                        string
+	biotypeTag, biotypeMode           string
+	chrAliases, format, filter        string
+	multiqc, multiqcFormat            string
+	sample, html                      string
 	cpu, maxBuf, reads                int
-	uniq                              bool
+	qcThresholds, maxMem              string
+	collectors                        []string
+	fraction                          float64
+	seed                              int64
+	uniq, fragments, qcFail           bool
 )
 
-func run(cmd *cobra.Command, args []string) (err error) {
-	err = nil
+// exit codes
+const (
+	exitError  = 1 // the statistics could not be computed
+	exitUsage  = 2 // invalid command line flags or values
+	exitFailed = 3 // failed checks: QC, annotation validation or comparison tolerances
+)
+
+// codeError is an error causing the program to exit with a specific code
+type codeError struct {
+	code int
+	err  error
+}
+
+func (e *codeError) Error() string {
+	return e.err.Error()
+}
+
+func withCode(code int, err error) error {
+	return &codeError{code, err}
+}
+
+func exitCode(err error) int {
+	if e, ok := err.(*codeError); ok {
+		return e.code
+	}
+	return exitError
+}
 
-	// Set loglevel
+func setLogLevel(cmd *cobra.Command, args []string) error {
 	level, err := log.ParseLevel(loglevel)
 	if err != nil {
-		return
+		return err
 	}
 	log.SetLevel(level)
+	return nil
+}
+
+func run(cmd *cobra.Command, args []string) (err error) {
+	err = nil
+
+	if format != "json" && format != "tsv" {
+		return withCode(exitUsage, fmt.Errorf("invalid output format: %s", format))
+	}
+	if multiqcFormat != "json" && multiqcFormat != "tsv" {
+		return withCode(exitUsage, fmt.Errorf("invalid MultiQC format: %s", multiqcFormat))
+	}
+	cfg, err := newConfig(cmd.Flags())
+	if err != nil {
+		return withCode(exitUsage, err)
+	}
+	if !stats.IsBiotypeMode(cfg.BiotypeMode) {
+		return withCode(exitUsage, fmt.Errorf("invalid biotype mode: %s", cfg.BiotypeMode))
+	}
+	if cfg.Fraction <= 0 || cfg.Fraction > 1 {
+		return withCode(exitUsage, fmt.Errorf("invalid sampling fraction: %g", cfg.Fraction))
+	}
+	if _, err := sam.NewFilter(cfg.Filter); err != nil {
+		return withCode(exitUsage, err)
+	}
+	report, err := progressReporter(progress)
+	if err != nil {
+		return withCode(exitUsage, err)
+	}
+	var thresholds stats.Thresholds
+	if cfg.QC != "" {
+		if thresholds, err = stats.ReadThresholds(cfg.QC); err != nil {
+			return withCode(exitUsage, err)
+		}
+	}
+	// flags are valid, do not print the usage for processing errors
+	cmd.SilenceUsage = true
+
 	// Get stats
 	logger := log.WithFields(log.Fields{
 		"version":   version,
@@ -38,29 +118,137 @@ func run(cmd *cobra.Command, args []string) (err error) {
 		"buildTime": date,
 	})
 	logger.Infof("Running %s", cmd.Use)
-	log.Infof("Using %v out of %v logical CPUs", cpu, runtime.NumCPU())
-	allStats, err := bamstats.Process(bam, annotation, cpu, maxBuf, reads, uniq)
+	log.Infof("Using %v out of %v logical CPUs", cfg.Cpu, runtime.NumCPU())
+	allStats, err := bamstats.Run(context.Background(), bamstats.Options{
+		Config:           cfg,
+		Input:            bam,
+		Progress:         report,
+		ProgressInterval: time.Second,
+	})
 	if err != nil {
 		return
 	}
 
+	var qc *stats.QCStats
+	if thresholds != nil {
+		qc, err = stats.EvaluateQC(allStats, thresholds)
+		if err != nil {
+			return
+		}
+		allStats.Add(qc)
+		log.Infof("QC status: %s", qc.Status)
+	}
+
+	if html != "" {
+		if err = writeHTML(allStats, html); err != nil {
+			return
+		}
+	}
+
+	if multiqc != "" {
+		if err = writeMultiQC(allStats, multiqc, multiqcFormat); err != nil {
+			return
+		}
+	}
+
 	w := utils.NewWriter(output)
-	allStats.OutputJSON(w)
+	if w == nil {
+		return fmt.Errorf("cannot create output file %s", output)
+	}
+	if format == "tsv" {
+		if err = allStats.OutputTSV(w); err != nil {
+			return
+		}
+		if err = utils.Flush(w); err != nil {
+			return
+		}
+	} else {
+		allStats.OutputJSON(w)
+	}
 
+	if qcFail && qc != nil && qc.Failed() {
+		return withCode(exitFailed, fmt.Errorf("QC failed"))
+	}
 	return
 }
 
+// configFlags set the processing settings from the command line flags
+var configFlags = map[string]func(cfg *config.Config) error{
+	"annotaion":    func(cfg *config.Config) error { cfg.Annotation = annotation; return nil },
+	"chr-aliases":  func(cfg *config.Config) error { cfg.ChrAliases = chrAliases; return nil },
+	"qc":           func(cfg *config.Config) error { cfg.QC = qcThresholds; return nil },
+	"cpu":          func(cfg *config.Config) error { cfg.Cpu = cpu; return nil },
+	"max-buf":      func(cfg *config.Config) error { cfg.MaxBuf = maxBuf; return nil },
+	"reads":        func(cfg *config.Config) error { cfg.Reads = reads; return nil },
+	"stats":        func(cfg *config.Config) error { cfg.Stats = collectors; return nil },
+	"filter":       func(cfg *config.Config) error { cfg.Filter = filter; return nil },
+	"fraction":     func(cfg *config.Config) error { cfg.Fraction = fraction; return nil },
+	"seed":         func(cfg *config.Config) error { cfg.Seed = seed; return nil },
+	"uniq":         func(cfg *config.Config) error { cfg.Uniq = uniq; return nil },
+	"fragments":    func(cfg *config.Config) error { cfg.Fragments = fragments; return nil },
+	"biotype-tag":  func(cfg *config.Config) error { cfg.BiotypeTag = biotypeTag; return nil },
+	"biotype-mode": func(cfg *config.Config) error { cfg.BiotypeMode = biotypeMode; return nil },
+	"max-mem": func(cfg *config.Config) error {
+		if maxMem == "" {
+			cfg.MaxMem = 0
+			return nil
+		}
+		return cfg.MaxMem.UnmarshalText([]byte(maxMem))
+	},
+}
+
+// newConfig returns the processing settings from the flag defaults, the config file, if any,
+// and the flags given in the command line, in increasing order of precedence.
+func newConfig(flags *pflag.FlagSet) (*config.Config, error) {
+	cfg := config.NewConfig(cpu, maxBuf, reads, uniq)
+	var err error
+	set := func(f *pflag.Flag) {
+		if setFlag, ok := configFlags[f.Name]; ok && err == nil {
+			err = setFlag(cfg)
+		}
+	}
+	flags.VisitAll(set)
+	// the default statistics depend on the annotation, leave them unset if not given
+	cfg.Stats = nil
+	if configFile != "" {
+		if err := config.Load(configFile, cfg); err != nil {
+			return nil, err
+		}
+	}
+	flags.Visit(set)
+	return cfg, err
+}
+
 func setBamstatsFlags(c *cobra.Command) {
-	c.PersistentFlags().StringVarP(&bam, "input", "i", "", "input file (required)")
-	c.PersistentFlags().StringVarP(&annotation, "annotaion", "a", "", "element annotation file")
 	c.PersistentFlags().StringVarP(&loglevel, "loglevel", "", "warn", "logging level")
-	c.PersistentFlags().StringVarP(&output, "output", "o", "-", "output file")
-	c.PersistentFlags().IntVarP(&cpu, "cpu", "c", runtime.NumCPU(), "number of cpus to be used")
-	c.PersistentFlags().IntVarP(&maxBuf, "max-buf", "", 1000000, "maximum number of buffered records")
-	c.PersistentFlags().IntVarP(&reads, "reads", "n", -1, "number of records to process")
-	c.PersistentFlags().BoolVarP(&uniq, "uniq", "u", false, "output genomic coverage statistics for uniqely mapped reads too")
+	c.Flags().StringVarP(&bam, "input", "i", "", "input file (required)")
+	c.Flags().StringVarP(&configFile, "config", "", "", "YAML or TOML file with the processing settings, overridden by the command line flags")
+	c.Flags().StringVarP(&annotation, "annotaion", "a", "", "element annotation file")
+	c.Flags().StringVarP(&chrAliases, "chr-aliases", "", "", "file with annotation and BAM chromosome name pairs, one per line")
+	c.Flags().StringVarP(&output, "output", "o", "-", "output file")
+	c.Flags().StringVarP(&format, "format", "f", "json", "output format (json|tsv)")
+	c.Flags().StringVarP(&multiqc, "multiqc", "", "", "write MultiQC custom content files using this path prefix")
+	c.Flags().StringVarP(&multiqcFormat, "multiqc-format", "", "json", "MultiQC custom content files format (json|tsv)")
+	c.Flags().StringVarP(&sample, "sample", "", "", "sample name used in MultiQC files (default: input file name without extension)")
+	c.Flags().StringVarP(&html, "html", "", "", "write a self-contained HTML report to this file")
+	c.Flags().StringVarP(&qcThresholds, "qc", "", "", "QC thresholds file (YAML or JSON) mapping metric paths to min/max limits")
+	c.Flags().BoolVarP(&qcFail, "qc-fail", "", false, "exit with a non-zero status if QC fails")
+	c.Flags().IntVarP(&cpu, "cpu", "c", runtime.NumCPU(), "number of cpus to be used")
+	c.Flags().IntVarP(&maxBuf, "max-buf", "", 1000000, "maximum number of buffered records")
+	c.Flags().StringVarP(&maxMem, "max-mem", "", "", "memory budget for buffered records, fragment mates and decompression, e.g. 2G (default unlimited)")
+	c.Flags().IntVarP(&reads, "reads", "n", -1, "number of records to process")
+	c.Flags().StringSliceVarP(&collectors, "stats", "", stats.DefaultCollectors, fmt.Sprintf("comma separated list of statistics to collect (available: %s)", strings.Join(stats.Collectors(), ",")))
+	c.Flags().StringVarP(&filter, "filter", "", "", fmt.Sprintf("expression selecting the records used for the statistics, e.g. 'mapq>=10 && !duplicate && tag(NH)==1' (fields: %s). Unmapped reads are not counted when a BAM index is used", strings.Join(sam.FilterFields(), ",")))
+	c.Flags().StringVarP(&progress, "progress", "", "", "report progress on stderr as a progress line or as log events (line|log)")
+	c.Flags().Lookup("progress").NoOptDefVal = "line"
+	c.Flags().Float64VarP(&fraction, "fraction", "", 1, "fraction of reads to sample, selected by read name keeping mates together")
+	c.Flags().Int64VarP(&seed, "seed", "", 0, "seed used for sampling reads")
+	c.Flags().BoolVarP(&uniq, "uniq", "u", false, "output genomic coverage statistics for uniqely mapped reads too")
+	c.Flags().BoolVarP(&fragments, "fragments", "", false, "classify read pairs as a unit and report coverage and RNA-seq statistics in fragments")
+	c.Flags().StringVarP(&biotypeTag, "biotype-tag", "", "gene_type", "annotation attribute containing the gene biotype (e.g. gene_biotype for Ensembl)")
+	c.Flags().StringVarP(&biotypeMode, "biotype-mode", "", stats.BiotypeAmbiguous, "how to count reads overlapping genes with different biotypes (ambiguous|all)")
 	// c.PersistentFlags().Bool("version", false, "show version and exit")
-	c.MarkPersistentFlagRequired("input")
+	c.MarkFlagRequired("input")
 
 	c.SetVersionTemplate(`{{with .Name}}{{printf "== %s ==\n" .}}{{end}}{{printf "%s\n" .Version}}`)
 }
@@ -77,17 +265,27 @@ func buildVersion(version, commit, date string) string {
 }
 
 func main() {
+	bamstats.Version = version
 	var rootCmd = &cobra.Command{
-		Use:     "bamstats",
-		Short:   "Mapping statistics",
-		Long:    "bamstats - compute mapping statistics",
-		RunE:    run,
-		Version: buildVersion(version, commit, date),
+		Use:               "bamstats",
+		Short:             "Mapping statistics",
+		Long:              "bamstats - compute mapping statistics",
+		RunE:              run,
+		PersistentPreRunE: setLogLevel,
+		Version:           buildVersion(version, commit, date),
 	}
 
 	setBamstatsFlags(rootCmd)
+	rootCmd.SetFlagErrorFunc(func(c *cobra.Command, err error) error {
+		return withCode(exitUsage, err)
+	})
+	rootCmd.AddCommand(newValidateCmd())
+	rootCmd.AddCommand(newElementsCmd())
+	rootCmd.AddCommand(newMergeCmd())
+	rootCmd.AddCommand(newCompareCmd())
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Debug(err)
+		os.Exit(exitCode(err))
 	}
 }
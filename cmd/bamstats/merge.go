@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/guigolab/bamstats"
+
+	"github.com/guigolab/bamstats/stats"
+	"github.com/guigolab/bamstats/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func readStatsFile(fileName string) (stats.Map, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := stats.ReadJSON(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return m, nil
+}
+
+// mergeStats merges the stats of the given maps into the first one and finalizes them
+func mergeStats(maps []stats.Map) stats.Map {
+	merged := maps[0]
+	for _, m := range maps {
+		if _, ok := m["qc"]; ok {
+			log.Info("QC sections are not merged")
+			delete(m, "qc")
+		}
+	}
+	for _, m := range maps[1:] {
+		for key, s := range m {
+			if _, ok := merged[key]; !ok {
+				log.Warnf("Stats section %s not found in all the input files", key)
+				merged[key] = s
+				continue
+			}
+			merged[key].Update(s)
+		}
+	}
+	for _, s := range merged {
+		s.Finalize()
+	}
+	return merged
+}
+
+func merge(cmd *cobra.Command, args []string) error {
+	start := time.Now()
+	var maps []stats.Map
+	for _, fileName := range args {
+		log.Infof("Reading %s", fileName)
+		m, err := readStatsFile(fileName)
+		if err != nil {
+			return err
+		}
+		maps = append(maps, m)
+	}
+	merged := mergeStats(maps)
+	meta, _ := merged["meta"].(*stats.Meta)
+	if meta == nil {
+		meta = &stats.Meta{}
+	}
+	merged.Add(stats.NewMeta(bamstats.Version, strings.Join(args, ","), meta.Annotation, meta.Parameters, start))
+	w := utils.NewWriter(output)
+	if w == nil {
+		return fmt.Errorf("cannot create output file %s", output)
+	}
+	switch format {
+	case "json":
+		if err := merged.OutputJSON(w); err != nil {
+			return err
+		}
+	case "tsv":
+		if err := merged.OutputTSV(w); err != nil {
+			return err
+		}
+	default:
+		return withCode(exitUsage, fmt.Errorf("invalid output format: %s", format))
+	}
+	return utils.Flush(w)
+}
+
+func newMergeCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:          "merge file.json...",
+		Short:        "Merge bamstats JSON files",
+		Long:         "Merge the statistics computed on different parts of the same sample (e.g. chromosomes or lanes) into a single result",
+		Args:         cobra.MinimumNArgs(1),
+		RunE:         merge,
+		SilenceUsage: true,
+	}
+	c.Flags().StringVarP(&output, "output", "o", "-", "output file")
+	c.Flags().StringVarP(&format, "format", "f", "json", "output format (json|tsv)")
+	return c
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/guigolab/bamstats"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxProgressRefs is the maximum number of references in progress shown in the progress line
+const maxProgressRefs = 3
+
+var progress string
+
+// progressReporter returns the function reporting the processing progress in the given mode
+func progressReporter(mode string) (func(bamstats.Progress), error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "line":
+		return progressLine(os.Stderr), nil
+	case "log":
+		logger := log.New()
+		logger.Out = os.Stderr
+		return progressLog(logger), nil
+	default:
+		return nil, fmt.Errorf("invalid progress mode: %s", mode)
+	}
+}
+
+// progressLine returns a function writing the progress to w as a single line, overwritten at each report
+func progressLine(w io.Writer) func(bamstats.Progress) {
+	width := 0
+	last := make(map[string]uint64)
+	return func(p bamstats.Progress) {
+		line := fmt.Sprintf("%d", p.Records)
+		if p.Expected > 0 {
+			line = fmt.Sprintf("%d/%d records (%.1f%%)", p.Records, p.Expected, 100*p.Fraction())
+		} else {
+			line += " records"
+		}
+		line += fmt.Sprintf(", %.0f records/s", p.Rate())
+		if eta := p.ETA().Round(time.Second); eta > 0 && !p.Done {
+			line += fmt.Sprintf(", ETA %v", eta)
+		}
+		var refs []string
+		for _, r := range activeRefs(p, last) {
+			if r.Expected > 0 {
+				refs = append(refs, fmt.Sprintf("%s %.0f%%", r.Name, 100*r.Fraction()))
+			} else {
+				refs = append(refs, r.Name)
+			}
+		}
+		if len(refs) > maxProgressRefs {
+			refs = append(refs[:maxProgressRefs], "...")
+		}
+		if len(refs) > 0 {
+			line += fmt.Sprintf(" [%s]", strings.Join(refs, ", "))
+		}
+		fmt.Fprintf(w, "\r%-*s", width, line)
+		width = len(line)
+		if p.Done {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// progressLog returns a function logging the overall progress and the progress of the references being processed
+func progressLog(logger *log.Logger) func(bamstats.Progress) {
+	last := make(map[string]uint64)
+	return func(p bamstats.Progress) {
+		fields := log.Fields{
+			"records": p.Records,
+			"rate":    fmt.Sprintf("%.0f", p.Rate()),
+			"elapsed": p.Elapsed.Round(time.Second).String(),
+		}
+		if p.Expected > 0 {
+			fields["expected"] = p.Expected
+			fields["percent"] = fmt.Sprintf("%.1f", 100*p.Fraction())
+			fields["eta"] = p.ETA().Round(time.Second).String()
+		}
+		msg := "Progress"
+		if p.Done {
+			msg = "Done"
+		}
+		logger.WithFields(fields).Info(msg)
+		for _, r := range activeRefs(p, last) {
+			fields := log.Fields{
+				"reference": r.Name,
+				"records":   r.Records,
+			}
+			if r.Expected > 0 {
+				fields["expected"] = r.Expected
+				fields["percent"] = fmt.Sprintf("%.1f", 100*r.Fraction())
+			}
+			logger.WithFields(fields).Info("Reference progress")
+		}
+	}
+}
+
+// activeRefs returns the references being processed, i.e. with records processed since the
+// last report and not all the expected ones. Last counts are updated in last.
+func activeRefs(p bamstats.Progress, last map[string]uint64) []bamstats.ReferenceProgress {
+	var refs []bamstats.ReferenceProgress
+	for _, r := range p.References {
+		if !p.Done && r.Records > last[r.Name] && (r.Expected == 0 || r.Records < r.Expected) {
+			refs = append(refs, r)
+		}
+		last[r.Name] = r.Records
+	}
+	return refs
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/guigolab/bamstats/stats"
+	"github.com/guigolab/bamstats/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// sampleName returns the sample name used in the MultiQC reports
+func sampleName() string {
+	if sample != "" {
+		return sample
+	}
+	return strings.TrimSuffix(filepath.Base(bam), filepath.Ext(bam))
+}
+
+// writeMultiQC writes a MultiQC custom content file named prefix_<section id>_mqc.<format> for
+// each section, format being json or tsv
+func writeMultiQC(allStats stats.Map, prefix, format string) error {
+	for _, section := range allStats.MultiQC(sampleName()) {
+		fileName := fmt.Sprintf("%s_%s_mqc.%s", prefix, section.ID, format)
+		w := utils.NewWriter(fileName)
+		if w == nil {
+			return fmt.Errorf("cannot create MultiQC file %s", fileName)
+		}
+		output := section.Output
+		if format == "tsv" {
+			output = section.OutputTSV
+		}
+		if err := output(w); err != nil {
+			return err
+		}
+		if err := utils.Flush(w); err != nil {
+			return err
+		}
+		log.Infof("MultiQC section written to %s", fileName)
+	}
+	return nil
+}
+
+// writeHTML writes the HTML report of the stats to fileName
+func writeHTML(allStats stats.Map, fileName string) error {
+	w := utils.NewWriter(fileName)
+	if w == nil {
+		return fmt.Errorf("cannot create HTML report %s", fileName)
+	}
+	if err := allStats.OutputHTML(w, fmt.Sprintf("bamstats report: %s", sampleName())); err != nil {
+		return err
+	}
+	log.Infof("HTML report written to %s", fileName)
+	return utils.Flush(w)
+}
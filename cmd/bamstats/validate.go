@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/guigolab/bamstats"
+	anno "github.com/guigolab/bamstats/annotation"
+	"github.com/guigolab/bamstats/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func validate(cmd *cobra.Command, args []string) error {
+	var chrLens map[string]int
+	if bam != "" {
+		chrLens = bamstats.ChrLens(bam)
+		if chrLens == nil {
+			return fmt.Errorf("cannot read the BAM header of %s", bam)
+		}
+	}
+	var aliases map[string]string
+	if chrAliases != "" {
+		var err error
+		aliases, err = anno.ReadChrAliases(chrAliases)
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(annotation)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	log.Infof("Validating %s", annotation)
+	problems, err := anno.Validate(f, chrLens, aliases)
+	if err != nil {
+		return err
+	}
+	w := utils.NewWriter(output)
+	for _, p := range problems {
+		fmt.Fprintln(w, p)
+	}
+	utils.Flush(w)
+	if len(problems) > 0 {
+		return withCode(exitFailed, fmt.Errorf("%d problems found in %s", len(problems), annotation))
+	}
+	log.Infof("No problems found in %s", annotation)
+	return nil
+}
+
+func newValidateCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:          "validate-annotation",
+		Short:        "Validate an annotation file",
+		Long:         "Check an annotation file for bad coordinates, missing gene_id attributes, exons outside their gene, unsorted features, GTF lines with more than 9 fields and, if a BAM file is given, chromosomes not found in the BAM header",
+		RunE:         validate,
+		SilenceUsage: true,
+	}
+	c.Flags().StringVarP(&annotation, "annotaion", "a", "", "element annotation file (required)")
+	c.Flags().StringVarP(&bam, "input", "i", "", "BAM file whose header is used to check chromosome names")
+	c.Flags().StringVarP(&chrAliases, "chr-aliases", "", "", "file with annotation and BAM chromosome name pairs, one per line")
+	c.Flags().StringVarP(&output, "output", "o", "-", "output file")
+	c.MarkFlagRequired("annotaion")
+	return c
+}
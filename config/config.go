@@ -1,10 +1,131 @@
 package config
 
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/guigolab/bamstats/utils"
+	yaml "gopkg.in/yaml.v2"
+)
+
 type Config struct {
-	Cpu, MaxBuf, Reads int
-	Uniq               bool
+	Annotation  string   `json:"annotation" yaml:"annotation" toml:"annotation"`
+	Cpu         int      `json:"cpu" yaml:"cpu" toml:"cpu"`
+	MaxBuf      int      `json:"max_buf" yaml:"max_buf" toml:"max_buf"`
+	MaxMem      Size     `json:"max_mem" yaml:"max_mem" toml:"max_mem"`
+	Reads       int      `json:"reads" yaml:"reads" toml:"reads"`
+	Uniq        bool     `json:"uniq" yaml:"uniq" toml:"uniq"`
+	Fragments   bool     `json:"fragments" yaml:"fragments" toml:"fragments"`
+	BiotypeTag  string   `json:"biotype_tag" yaml:"biotype_tag" toml:"biotype_tag"`
+	BiotypeMode string   `json:"biotype_mode" yaml:"biotype_mode" toml:"biotype_mode"`
+	ChrAliases  string   `json:"chr_aliases" yaml:"chr_aliases" toml:"chr_aliases"`
+	Stats       []string `json:"stats" yaml:"stats" toml:"stats"`
+	Filter      string   `json:"filter" yaml:"filter" toml:"filter"`
+	Fraction    float64  `json:"fraction" yaml:"fraction" toml:"fraction"`
+	Seed        int64    `json:"seed" yaml:"seed" toml:"seed"`
+	QC          string   `json:"qc" yaml:"qc" toml:"qc"`
 }
 
 func NewConfig(cpu, maxBuf, reads int, uniq bool) *Config {
-	return &Config{cpu, maxBuf, reads, uniq}
+	return &Config{
+		Cpu:         cpu,
+		MaxBuf:      maxBuf,
+		Reads:       reads,
+		Uniq:        uniq,
+		BiotypeTag:  "gene_type",
+		BiotypeMode: "ambiguous",
+		Fraction:    1,
+	}
+}
+
+// Load reads the settings in a YAML or TOML file into cfg. Files with the .toml extension
+// are read as TOML, and any other file as YAML, which includes JSON. Settings missing from
+// the file are left unchanged, while unknown settings are reported as errors. Relative file
+// paths in the file (annotation, chr_aliases and qc) are relative to the file's directory.
+func Load(fileName string, cfg *Config) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	paths := []*string{&cfg.Annotation, &cfg.ChrAliases, &cfg.QC}
+	prev := make([]string, len(paths))
+	for i, p := range paths {
+		prev[i], *p = *p, ""
+	}
+	if err := decode(fileName, data, cfg); err != nil {
+		return err
+	}
+	dir := filepath.Dir(fileName)
+	for i, p := range paths {
+		switch {
+		case *p == "":
+			*p = prev[i]
+		case !filepath.IsAbs(*p):
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	return nil
+}
+
+func decode(fileName string, data []byte, cfg *Config) error {
+	if strings.ToLower(filepath.Ext(fileName)) == ".toml" {
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fileName, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown setting %s", fileName, undecoded[0])
+		}
+		return nil
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("%s: %v", fileName, err)
+	}
+	return nil
+}
+
+// Size is a size in bytes. In configuration files it can be given as a number or as a string
+// with a binary unit suffix, e.g. 2G.
+type Size int64
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface
+func (s *Size) UnmarshalText(text []byte) error {
+	n, err := utils.ParseSize(string(text))
+	if err != nil {
+		return err
+	}
+	*s = Size(n)
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface
+func (s *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var n int64
+	if err := unmarshal(&n); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+	return s.UnmarshalText([]byte(text))
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var n int64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	return s.UnmarshalText([]byte(text))
 }
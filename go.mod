@@ -3,9 +3,14 @@ module github.com/guigolab/bamstats
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/biogo/boom v0.0.0-20150317015657-28119bc1ffc1 // indirect
 	github.com/biogo/hts v1.0.1
 	github.com/dhconnelly/rtreego v0.0.0-20180422140909-3fb2815d35b2
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
+	github.com/xeipuuv/gojsonschema v1.2.0
+	golang.org/x/sync v0.1.0
+	gopkg.in/yaml.v2 v2.4.0
 )
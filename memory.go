@@ -0,0 +1,56 @@
+package bamstats
+
+import (
+	"runtime"
+	"time"
+)
+
+// memoryInterval is the interval between memory usage samples
+const memoryInterval = 200 * time.Millisecond
+
+// memoryMonitor samples the memory usage of the process and keeps its peak.
+type memoryMonitor struct {
+	heap, sys uint64
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func startMemoryMonitor() *memoryMonitor {
+	m := &memoryMonitor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(memoryInterval)
+		defer ticker.Stop()
+		for {
+			m.sample()
+			select {
+			case <-ticker.C:
+			case <-m.stop:
+				m.sample()
+				return
+			}
+		}
+	}()
+	return m
+}
+
+func (m *memoryMonitor) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if ms.HeapInuse > m.heap {
+		m.heap = ms.HeapInuse
+	}
+	if ms.Sys > m.sys {
+		m.sys = ms.Sys
+	}
+}
+
+// Stop stops the sampling and returns the peak heap in use and the peak memory obtained from the OS.
+func (m *memoryMonitor) Stop() (heap, sys uint64) {
+	close(m.stop)
+	<-m.done
+	return m.heap, m.sys
+}
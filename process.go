@@ -2,84 +2,173 @@
 package bamstats
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
-	"sync"
+	"runtime"
+	"runtime/debug"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/biogo/hts/bam"
+	hts "github.com/biogo/hts/sam"
 	"github.com/guigolab/bamstats/annotation"
 	"github.com/guigolab/bamstats/config"
 	"github.com/guigolab/bamstats/sam"
 	"github.com/guigolab/bamstats/stats"
+	"github.com/guigolab/bamstats/utils"
+	"golang.org/x/sync/errgroup"
 )
 
+// Version is the bamstats version reported in the output metadata
+var Version = "dev"
+
 func init() {
 	log.SetLevel(log.WarnLevel)
 }
 
-// var wg sync.WaitGroup
+// Options are the inputs and settings for collecting mapping statistics with Run.
+type Options struct {
+	// Config holds the processing settings. Default settings are used if nil.
+	Config *config.Config
+	// Input is the BAM file name. Its index, with the .bai extension, is used if present.
+	Input string
+	// InputReader, if not nil, is read instead of the Input file, which is then only reported
+	// in the output metadata. If InputReader implements io.ReaderAt, the references are read
+	// concurrently using the BAM index read from IndexReader.
+	InputReader io.Reader
+	// IndexReader provides the BAM index for InputReader.
+	IndexReader io.Reader
+	// Annotation is the annotation file name. The annotation in Config is used if empty.
+	Annotation string
+	// AnnotationReader, if not nil, is read instead of the Annotation file.
+	AnnotationReader io.Reader
+	// AnnotationIndex, if not nil, is used instead of creating an index from the annotation.
+	AnnotationIndex *annotation.RtreeMap
+	// Collectors create further statistics to be collected, besides the ones selected in Config.
+	Collectors []stats.Constructor
+	// Progress, if not nil, is called with the processing progress at each ProgressInterval,
+	// five seconds by default, and once more when done.
+	Progress         func(Progress)
+	ProgressInterval time.Duration
+}
 
-func worker(id int, in interface{}, out chan stats.Map, index *annotation.RtreeMap, cfg *config.Config, wg *sync.WaitGroup) {
-	defer wg.Done()
+func worker(ctx context.Context, id int, in interface{}, sm stats.Map, filter *sam.Filter, tracker *progressTracker) (err error) {
 	logger := log.WithFields(log.Fields{
 		"worker": id,
 	})
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Debugf("%s", debug.Stack())
+			err = fmt.Errorf("worker %d: %v", id, r)
+		}
+	}()
 	logger.Debug("Starting")
 
-	sm := makeStatsMap(index, cfg)
-
-	collectStats(in, sm)
+	if err := collectStats(ctx, in, sm, filter, tracker); err != nil {
+		return err
+	}
 
 	logger.Debug("Done")
-
-	out <- sm
+	return nil
 }
 
-func collectStats(in interface{}, sm stats.Map) {
+// collectStats collects the stats of the records passing the filter, if any, read from in.
+func collectStats(ctx context.Context, in interface{}, sm stats.Map, filter *sam.Filter, tracker *progressTracker) error {
+	done := ctx.Done()
+	collect := func(record *sam.Record) {
+		if tracker != nil {
+			tracker.add(record.Record)
+		}
+		if filter != nil && !filter.Match(record) {
+			return
+		}
+		for _, s := range sm {
+			s.Collect(record)
+		}
+	}
 	switch in.(type) {
 	case chan *sam.Record:
 		c := in.(chan *sam.Record)
 		for record := range c {
-			for _, s := range sm {
-				s.Collect(record)
+			select {
+			case <-done:
+				return ctx.Err()
+			default:
 			}
+			collect(record)
 		}
 	case chan *sam.Iterator:
 		iterators := in.(chan *sam.Iterator)
 		for it := range iterators {
-			for it.Next() {
-				for _, s := range sm {
-					s.Collect(it.Record())
-				}
+			if err := collectIterator(ctx, it, collect); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
 }
 
-func process(bamFile string, index *annotation.RtreeMap, cpu int, maxBuf int, reads int, uniq bool) (stats.Map, error) {
-
-	var wg sync.WaitGroup
-
-	conf := config.NewConfig(cpu, maxBuf, reads, uniq)
+// collectIterator collects the records read from it, which is closed when returning.
+func collectIterator(ctx context.Context, it *sam.Iterator, collect func(*sam.Record)) error {
+	defer it.Close()
+	done := ctx.Done()
+	for it.Next() {
+		select {
+		case <-done:
+			return ctx.Err()
+		default:
+		}
+		collect(it.Record())
+	}
+	return it.Error()
+}
 
-	br, err := sam.NewReader(bamFile, conf)
-	defer br.Close()
+func newStatsMap(index *annotation.RtreeMap, cfg *config.Config, collectors []stats.Constructor) (stats.Map, error) {
+	m, err := stats.NewMapFromConfig(index, cfg)
 	if err != nil {
 		return nil, err
 	}
-	statChan := make(chan stats.Map, cpu)
-	for i := 0; i < br.Workers; i++ {
-		id := i + 1
-		wg.Add(1)
-		go worker(id, br.Channels[i], statChan, index, conf, &wg)
+	for _, c := range collectors {
+		if s := c(index, cfg); s != nil {
+			m.Add(s)
+		}
+	}
+	return m, nil
+}
+
+func process(ctx context.Context, br *sam.Reader, index *annotation.RtreeMap, conf *config.Config, collectors []stats.Constructor, tracker *progressTracker) (stats.Map, error) {
+	maps := make([]stats.Map, br.Workers)
+	for i := range maps {
+		var err error
+		maps[i], err = newStatsMap(index, conf, collectors)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	go br.Read()
+	g, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < br.Workers; i++ {
+		id, in, sm := i+1, br.Channels[i], maps[i]
+		g.Go(func() error {
+			return worker(ctx, id, in, sm, br.Filter(), tracker)
+		})
+	}
+	g.Go(func() error {
+		return br.ReadContext(ctx)
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
 
-	go waitProcess(statChan, &wg)
-	stat := <-statChan
-	stat.Merge(statChan)
+	others := make(chan stats.Map, len(maps))
+	for _, m := range maps[1:] {
+		others <- m
+	}
+	close(others)
+	stat := maps[0]
+	stat.Merge(others)
 	for k, v := range stat {
 		switch k {
 		case "general":
@@ -98,11 +187,6 @@ func process(bamFile string, index *annotation.RtreeMap, cpu int, maxBuf int, re
 	return stat, nil
 }
 
-func waitProcess(st chan stats.Map, wg *sync.WaitGroup) {
-	wg.Wait()
-	close(st)
-}
-
 func getChrLens(bamFile string, cpu int) (chrs map[string]int) {
 	bf, err := os.Open(bamFile)
 	if err != nil {
@@ -120,34 +204,131 @@ func getChrLens(bamFile string, cpu int) (chrs map[string]int) {
 	return
 }
 
+// ChrLens returns the reference names and lengths from the header of the BAM file.
+func ChrLens(bamFile string) map[string]int {
+	return getChrLens(bamFile, 1)
+}
+
 // Process process the input BAM file and collect different mapping stats.
 func Process(bamFile string, anno string, cpu int, maxBuf int, reads int, uniq bool) (stats.Map, error) {
-	var index *annotation.RtreeMap
-	if anno != "" {
-		log.Infof("Creating index for %s", anno)
+	return ProcessWithConfig(bamFile, anno, config.NewConfig(cpu, maxBuf, reads, uniq))
+}
+
+// ProcessWithConfig process the input BAM file and collect different mapping stats using the settings in cfg.
+func ProcessWithConfig(bamFile string, anno string, cfg *config.Config) (stats.Map, error) {
+	return Run(context.Background(), Options{
+		Config:     cfg,
+		Input:      bamFile,
+		Annotation: anno,
+	})
+}
+
+// Run collects the mapping stats for the inputs in opts. Processing stops, returning
+// the context error, if ctx is cancelled.
+func Run(ctx context.Context, opts Options) (stats.Map, error) {
+	runStart := time.Now()
+	if log.IsLevelEnabled(log.DebugLevel) {
+		monitor := startMemoryMonitor()
+		defer func() {
+			heap, sys := monitor.Stop()
+			log.WithFields(log.Fields{
+				"Heap": utils.FormatSize(heap),
+				"Sys":  utils.FormatSize(sys),
+			}).Debug("Peak memory usage")
+		}()
+	}
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = config.NewConfig(runtime.GOMAXPROCS(-1), 1000000, -1, false)
+	}
+	if opts.Annotation == "" {
+		opts.Annotation = cfg.Annotation
+	}
+	br, err := openBam(opts, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	index := opts.AnnotationIndex
+	if index == nil && (opts.Annotation != "" || opts.AnnotationReader != nil) {
+		log.Infof("Creating index for %s", opts.Annotation)
 		start := time.Now()
-		chrLens := getChrLens(bamFile, cpu)
-		index = annotation.CreateIndex(anno, chrLens)
+		index, err = createIndex(opts, br.Refs, cfg)
+		if err != nil {
+			return nil, err
+		}
 		log.Infof("Index done in %v", time.Since(start))
 	}
 	start := time.Now()
-	log.Infof("Collecting stats for %s", bamFile)
-	allStats, err := process(bamFile, index, cpu, maxBuf, reads, uniq)
+	log.Infof("Collecting stats for %s", opts.Input)
+	var tracker *progressTracker
+	stopProgress := func() {}
+	if opts.Progress != nil {
+		tracker = newProgressTracker(br.Refs, br.Mapped(), cfg.Reads)
+		interval := opts.ProgressInterval
+		if interval <= 0 {
+			interval = defaultProgressInterval
+		}
+		pctx, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			tracker.run(pctx, interval, opts.Progress)
+			close(done)
+		}()
+		stopProgress = func() {
+			stop()
+			<-done
+		}
+	}
+	allStats, err := process(ctx, br, index, cfg, opts.Collectors, tracker)
+	stopProgress()
 	if err != nil {
 		return nil, err
 	}
+	if tracker != nil {
+		opts.Progress(tracker.snapshot(true))
+	}
 	log.Infof("Stats done in %v", time.Since(start))
+	meta := stats.NewMeta(Version, opts.Input, opts.Annotation, cfg, runStart)
+	if s := br.Sampler(); s != nil {
+		meta.Sampling = stats.NewSampling(s.Records(), s.Kept())
+		log.Infof("Sampled %d out of %d records", s.Kept(), s.Records())
+	}
+	allStats.Add(meta)
 	return allStats, nil
 }
 
-func makeStatsMap(index *annotation.RtreeMap, cfg *config.Config) stats.Map {
-	m := stats.NewMap(stats.NewGeneralStats())
-	if index != nil {
-		m.Add(stats.NewCoverageStats(index, false))
-		if cfg.Uniq {
-			m.Add(stats.NewCoverageStats(index, true))
+func openBam(opts Options, cfg *config.Config) (*sam.Reader, error) {
+	if opts.InputReader != nil {
+		return sam.NewReaderFrom(opts.InputReader, opts.IndexReader, cfg)
+	}
+	return sam.NewReader(opts.Input, cfg)
+}
+
+func createIndex(opts Options, refs []*hts.Reference, cfg *config.Config) (*annotation.RtreeMap, error) {
+	chrLens := make(map[string]int, len(refs))
+	for _, r := range refs {
+		chrLens[r.Name()] = r.Len()
+	}
+	var aliases map[string]string
+	if cfg.ChrAliases != "" {
+		var err error
+		aliases, err = annotation.ReadChrAliases(cfg.ChrAliases)
+		if err != nil {
+			return nil, err
 		}
-		m.Add(stats.NewIHECstats(index))
 	}
-	return m
+	r := opts.AnnotationReader
+	if r == nil {
+		f, err := os.Open(opts.Annotation)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return annotation.CreateIndexFromReader(r, chrLens, annotation.IndexOptions{
+		ChrAliases: aliases,
+		BiotypeTag: cfg.BiotypeTag,
+	})
 }
@@ -2,13 +2,23 @@ package bamstats
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	hts "github.com/biogo/hts/sam"
+	"github.com/guigolab/bamstats/annotation"
+	"github.com/guigolab/bamstats/config"
+	"github.com/guigolab/bamstats/sam"
 	"github.com/guigolab/bamstats/stats"
+	"github.com/xeipuuv/gojsonschema"
 )
 
 func checkTest(err error, t *testing.T) {
@@ -20,13 +30,16 @@ func checkTest(err error, t *testing.T) {
 var (
 	bamFile      = "data/process-test.bam"
 	expectedJSON = map[string]string{
-		"general":      "data/expected-general.json",
-		"coverage":     "data/expected-coverage.json",
-		"coverageUniq": "data/expected-coverage-uniq.json",
-		"rnaseq":       "data/expected-rnaseq.json",
+		"general":         "data/expected-general.json",
+		"coverage":        "data/expected-coverage.json",
+		"coverageUniq":    "data/expected-coverage-uniq.json",
+		"coverageGtf":     "data/expected-coverage-gtf.json",
+		"coverageUniqGtf": "data/expected-coverage-uniq-gtf.json",
+		"rnaseq":          "data/expected-rnaseq.json",
 	}
-	expectedMapLenCoverage     = 3
-	expectedMapLenCoverageUniq = 4
+	expectedMapLenGeneral      = 2
+	expectedMapLenCoverage     = 4
+	expectedMapLenCoverageUniq = 5
 	annotationFiles            = []string{"data/coverage-test.bed", "data/coverage-test.gtf.gz", "data/coverage-test-shuffled.bed", "data/coverage-test-shuffled.gtf.gz"}
 	maxBuf                     = 1000000
 	reads                      = -1
@@ -37,14 +50,14 @@ func TestGeneral(t *testing.T) {
 	out, err := Process(bamFile, "", runtime.GOMAXPROCS(-1), maxBuf, reads, false)
 	checkTest(err, t)
 	l := len(out)
-	if l > 1 {
-		t.Errorf("(Process) Expected StatsMap of length 1, got %d", l)
+	if l > expectedMapLenGeneral {
+		t.Errorf("(Process) Expected StatsMap of length %d, got %d", expectedMapLenGeneral, l)
 	}
 	_, ok := out["general"].(*stats.GeneralStats)
 	if !ok {
 		t.Errorf("(Process) Wrong return type - expected GeneralStats, got %T", out["general"])
 	}
-	out.OutputJSON(&b)
+	stats.NewMap(out["general"]).OutputJSON(&b)
 	stats := readStats([]string{"general"}, t)
 	// stats := readExpected(expectedGeneralJSON, t)
 	if len(b.Bytes()) != len(stats) {
@@ -60,8 +73,8 @@ func TestIssue18(t *testing.T) {
 	out, err := Process("data/issue18.bam", "", runtime.GOMAXPROCS(-1), maxBuf, reads, false)
 	checkTest(err, t)
 	l := len(out)
-	if l != 1 {
-		t.Errorf("(Process) Expected StatsMap of length 1, got %d", l)
+	if l != expectedMapLenGeneral {
+		t.Errorf("(Process) Expected StatsMap of length %d, got %d", expectedMapLenGeneral, l)
 	}
 	_, ok := out["general"].(*stats.GeneralStats).Reads.Mapped[1]
 	if !ok {
@@ -89,7 +102,7 @@ func TestCoverage(t *testing.T) {
 			t.Errorf("(Process) Wrong return type - expected CoverageStats, got %T", out["coverage"])
 		}
 		stats.NewMap(out["coverage"]).OutputJSON(&b)
-		stats := readStats([]string{"coverage"}, t)
+		stats := readAnnotationStats("coverage", annotationFile, t)
 		if len(b.Bytes()) != len(stats) {
 			err := dump(b, "observed-coverage.json")
 			if err != nil {
@@ -124,7 +137,7 @@ func TestCoverageUniq(t *testing.T) {
 			t.Errorf("(Process) Wrong return type - expected CoverageStats, got %T", out["coverageUniq"])
 		}
 		stats.NewMap(out["coverageUniq"]).OutputJSON(&b)
-		stats := readStats([]string{"coverageUniq"}, t)
+		stats := readAnnotationStats("coverageUniq", annotationFile, t)
 		if len(b.Bytes()) != len(stats) {
 			err := dump(b, "observed-coverage-uniq.json")
 			if err != nil {
@@ -169,6 +182,791 @@ func TestRNAseq(t *testing.T) {
 	}
 }
 
+func TestBiotypes(t *testing.T) {
+	annotationFile := "data/coverage-test.gtf.gz"
+	var counts [2]stats.BiotypeStats
+	for i, mode := range []string{stats.BiotypeAmbiguous, stats.BiotypeAll} {
+		cfg := config.NewConfig(runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+		cfg.BiotypeMode = mode
+		out, err := ProcessWithConfig(bamFile, annotationFile, cfg)
+		checkTest(err, t)
+		s, ok := out["rnaseq"].(*stats.RNAseqStats)
+		if !ok {
+			t.Fatalf("(Process) Wrong return type - expected RNAseqStats, got %T", out["rnaseq"])
+		}
+		counts[i] = s.Biotypes
+		mapped := out["general"].(*stats.GeneralStats).Reads.Mapped.Total()
+		if s.Biotypes[stats.Total] != mapped {
+			t.Errorf("(Process) %s: expected %d reads in biotypes total, got %d", mode, mapped, s.Biotypes[stats.Total])
+		}
+	}
+	var sum uint64
+	for _, k := range counts[0].Keys() {
+		if k != stats.Total {
+			sum += counts[0][k]
+		}
+	}
+	if sum != counts[0][stats.Total] {
+		t.Errorf("(Process) ambiguous biotype counts sum to %d, expected %d", sum, counts[0][stats.Total])
+	}
+	if counts[1][stats.Ambiguous] != 0 {
+		t.Errorf("(Process) expected no ambiguous reads counting all biotypes, got %d", counts[1][stats.Ambiguous])
+	}
+	for bt, n := range counts[0] {
+		if bt != stats.Ambiguous && counts[1][bt] < n {
+			t.Errorf("(Process) expected at least %d %s reads counting all biotypes, got %d", n, bt, counts[1][bt])
+		}
+	}
+}
+
+func TestOutputTSV(t *testing.T) {
+	var b bytes.Buffer
+	out, err := Process(bamFile, "data/coverage-test.bed", runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+	checkTest(err, t)
+	if err := out.OutputTSV(&b); err != nil {
+		t.Fatalf("(OutputTSV) unexpected error: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if lines[0] != "section\tsubsection\tkey\tvalue" {
+		t.Errorf("(OutputTSV) bad header: %q", lines[0])
+	}
+	for _, row := range []string{
+		"coverage\ttotal\texon\t13058",
+		"coverage\tsplit\ttotal\t6649",
+		"general\t\tprotocol\tPairedEnd",
+		"general\treads.mapped\t1\t13639",
+		"general\treads.mappings\tratio\t2.37304",
+	} {
+		found := false
+		for _, l := range lines {
+			if l == row {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("(OutputTSV) row %q not found", row)
+		}
+	}
+	for i, l := range lines {
+		if n := len(strings.Split(l, "\t")); n != 4 {
+			t.Errorf("(OutputTSV) line %d: expected 4 columns, got %d", i+1, n)
+		}
+	}
+	var again bytes.Buffer
+	out.OutputTSV(&again)
+	if again.String() != b.String() {
+		t.Error("(OutputTSV) output is not stable")
+	}
+}
+
+func TestMultiQC(t *testing.T) {
+	out, err := Process(bamFile, "data/coverage-test.gtf.gz", runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+	checkTest(err, t)
+	sections := out.MultiQC("sample")
+	ids := []string{stats.MultiQCGeneral, stats.MultiQCCoverage, stats.MultiQCMultimap, stats.MultiQCInsertSizes}
+	if len(sections) != len(ids) {
+		t.Fatalf("(MultiQC) expected %d sections, got %d", len(ids), len(sections))
+	}
+	for i, s := range sections {
+		if s.ID != ids[i] {
+			t.Errorf("(MultiQC) expected section %s, got %s", ids[i], s.ID)
+		}
+		if _, ok := s.Data["sample"]; !ok {
+			t.Errorf("(MultiQC) %s: sample data not found", s.ID)
+		}
+	}
+	general := sections[0].Data["sample"].(map[string]interface{})
+	for _, k := range []string{"mapped_pct", "duplicates_pct", "rrna_pct", "intergenic_pct"} {
+		if _, ok := general[k]; !ok {
+			t.Errorf("(MultiQC) general stats column %s not found", k)
+		}
+	}
+	if general["mapped_pct"] != float64(100) {
+		t.Errorf("(MultiQC) expected 100%% mapped reads, got %v", general["mapped_pct"])
+	}
+	var b bytes.Buffer
+	if err := sections[1].Output(&b); err != nil {
+		t.Fatalf("(MultiQC) output error: %s", err)
+	}
+	var section map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &section); err != nil {
+		t.Fatalf("(MultiQC) invalid JSON output: %s", err)
+	}
+	if section["plot_type"] != "bargraph" {
+		t.Errorf("(MultiQC) expected bargraph plot type, got %v", section["plot_type"])
+	}
+	b.Reset()
+	if err := sections[1].OutputTSV(&b); err != nil {
+		t.Fatalf("(MultiQC) TSV output error: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if lines[0] != "# id: \""+stats.MultiQCCoverage+"\"" {
+		t.Errorf("(MultiQC) TSV section id error: %s", lines[0])
+	}
+	header := "Sample\texon\texonic_intronic\tintron\tintergenic\tothers"
+	if lines[len(lines)-2] != header {
+		t.Errorf("(MultiQC) TSV header error.\ngot: %s\nexp: %s", lines[len(lines)-2], header)
+	}
+	if !strings.HasPrefix(lines[len(lines)-1], "sample\t") {
+		t.Errorf("(MultiQC) TSV sample row error: %s", lines[len(lines)-1])
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	var b, again bytes.Buffer
+	out, err := Process(bamFile, "data/coverage-test.gtf.gz", runtime.GOMAXPROCS(-1), maxBuf, reads, true)
+	checkTest(err, t)
+	out.OutputJSON(&b)
+	m, err := stats.ReadJSON(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("(ReadJSON) unexpected error: %s", err)
+	}
+	if len(m) != len(out) {
+		t.Errorf("(ReadJSON) expected %d stats, got %d", len(out), len(m))
+	}
+	m.OutputJSON(&again)
+	if again.String() != b.String() {
+		t.Error("(ReadJSON) JSON output differs after reading it back")
+	}
+
+	other, _ := stats.ReadJSON(bytes.NewReader(b.Bytes()))
+	maps := make(chan stats.Map, 1)
+	maps <- other
+	close(maps)
+	m.Merge(maps)
+	for _, s := range m {
+		s.Finalize()
+	}
+	g := m["general"].(*stats.GeneralStats)
+	if exp := 2 * out["general"].(*stats.GeneralStats).Reads.Total; g.Reads.Total != exp {
+		t.Errorf("(Merge) expected %d total reads, got %d", exp, g.Reads.Total)
+	}
+	c := m["coverageUniq"].(*stats.CoverageStats)
+	if exp := 2 * out["coverageUniq"].(*stats.CoverageStats).Total[stats.Exon]; c.Total[stats.Exon] != exp {
+		t.Errorf("(Merge) expected %d exonic uniquely mapped reads, got %d", exp, c.Total[stats.Exon])
+	}
+	r, exp := m["rnaseq"].(*stats.RNAseqStats), out["rnaseq"].(*stats.RNAseqStats)
+	if r.Intergenic != 2*exp.Intergenic || *r.Metrics != *exp.Metrics {
+		t.Errorf("(Merge) expected %d intergenic reads and metrics %v, got %d and %v", 2*exp.Intergenic, *exp.Metrics, r.Intergenic, *r.Metrics)
+	}
+
+	// the rnaseq read counts do not depend on the general section
+	var rnaseq bytes.Buffer
+	stats.NewMap(out["rnaseq"]).OutputJSON(&rnaseq)
+	var merged stats.RNAseqStats
+	for i := 0; i < 2; i++ {
+		m, err := stats.ReadJSON(bytes.NewReader(rnaseq.Bytes()))
+		if err != nil {
+			t.Fatalf("(ReadJSON) unexpected error: %s", err)
+		}
+		r := m["rnaseq"].(*stats.RNAseqStats)
+		// stale metrics must be recomputed from the counts
+		r.Metrics.Mapped, r.Metrics.RRNA = 0, 0
+		if i == 0 {
+			merged = *r
+			continue
+		}
+		merged.Update(r)
+	}
+	merged.Finalize()
+	counts := stats.RNAseqCounts{Total: 2 * exp.Reads.Total, Mapped: 2 * exp.Reads.Mapped, Duplicates: 2 * exp.Reads.Duplicates}
+	if *merged.Reads != counts {
+		t.Errorf("(Merge) without general stats: expected read counts %v, got %v", counts, *merged.Reads)
+	}
+	if *merged.Metrics != *exp.Metrics {
+		t.Errorf("(Merge) without general stats: expected metrics %v, got %v", *exp.Metrics, *merged.Metrics)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	var b bytes.Buffer
+	out, err := Process(bamFile, "data/coverage-test.bed", runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+	checkTest(err, t)
+	out.OutputJSON(&b)
+	other, err := stats.ReadJSON(bytes.NewReader(b.Bytes()))
+	checkTest(err, t)
+	c := other["coverage"].(*stats.CoverageStats)
+	c.Continuous[stats.Exon] += 1000
+	c.Finalize()
+
+	var tolerances []*stats.Tolerance
+	for _, s := range []string{"coverage.total.exon_share=1%", "coverage.split.*=0", "coverage.total.exon=1000"} {
+		tol, err := stats.ParseTolerance(s)
+		checkTest(err, t)
+		tolerances = append(tolerances, tol)
+	}
+	diffs, err := stats.Compare(out, other, tolerances)
+	checkTest(err, t)
+	status := make(map[string]string)
+	for _, d := range diffs {
+		status[d.Path] = d.Status()
+		if d.Path == "coverage.total.exon" && (d.Abs() != 1000 || d.Rel() != 1000/float64(d.A)) {
+			t.Errorf("(Compare) expected a difference of 1000 exonic reads, got %v (%v)", d.Abs(), d.Rel())
+		}
+	}
+	for p, exp := range map[string]string{
+		"coverage.total.exon_share": "FAIL",
+		"coverage.total.exon":       "OK",
+		"coverage.split.exon":       "OK",
+		"coverage.continuous.exon":  "",
+		"general.reads.total":       "",
+	} {
+		if st, ok := status[p]; !ok || st != exp {
+			t.Errorf("(Compare) %s: expected status %q, got %q", p, exp, st)
+		}
+	}
+	for _, s := range []string{"exon", "exon=", "exon=-1", "exon=a%"} {
+		if _, err := stats.ParseTolerance(s); err == nil {
+			t.Errorf("(ParseTolerance) expected error parsing %q", s)
+		}
+	}
+}
+
+func TestQC(t *testing.T) {
+	out, err := Process(bamFile, "data/coverage-test.gtf.gz", runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+	checkTest(err, t)
+	for _, c := range []struct {
+		name, thresholds, status string
+		metrics                  map[string]string
+	}{
+		{"thresholds.yaml", `rnaseq.metrics.fraction_mapped:
+  min: 0.7
+  warn_min: 0.8
+coverage.total.exon_share:
+  warn_min: 0.5
+`, stats.QCWarn, map[string]string{"rnaseq.metrics.fraction_mapped": stats.QCPass, "coverage.total.exon_share": stats.QCWarn}},
+		{"thresholds.json", `{"rnaseq.metrics.fraction_intergenic": {"max": 0.001}, "rnaseq.metrics.fraction_mapped": {"min": 0.5}}`,
+			stats.QCFail, map[string]string{"rnaseq.metrics.fraction_intergenic": stats.QCFail, "rnaseq.metrics.fraction_mapped": stats.QCPass}},
+		{"missing.yaml", `rnaseq.metrics.missing:
+  max: 1
+`, stats.QCWarn, map[string]string{"rnaseq.metrics.missing": stats.QCWarn}},
+	} {
+		dir, err := ioutil.TempDir("", "bamstats")
+		checkTest(err, t)
+		defer os.RemoveAll(dir)
+		fileName := dir + "/" + c.name
+		checkTest(ioutil.WriteFile(fileName, []byte(c.thresholds), 0644), t)
+		thresholds, err := stats.ReadThresholds(fileName)
+		if err != nil {
+			t.Fatalf("(ReadThresholds) %s: unexpected error: %s", c.name, err)
+		}
+		qc, err := stats.EvaluateQC(out, thresholds)
+		checkTest(err, t)
+		if qc.Status != c.status {
+			t.Errorf("(EvaluateQC) %s: expected status %s, got %s", c.name, c.status, qc.Status)
+		}
+		for p, st := range c.metrics {
+			if m, ok := qc.Metrics[p]; !ok || m.Status != st {
+				t.Errorf("(EvaluateQC) %s: expected %s status %s, got %v", c.name, p, st, m)
+			}
+		}
+	}
+}
+
+func TestMultimaps(t *testing.T) {
+	// reads without NH tags, as written by DNA aligners
+	lines := []string{
+		"r001	0	ref	7	60	9M	*	0	0	CAGCGGCAT	*\n",
+		"r002	0	ref	7	0	9M	*	0	0	CAGCGGCAT	*\n",
+		"r002	256	ref	27	0	9M	*	0	0	CAGCGGCAT	*\n",
+		"r003	0	ref	7	50	9M	*	0	0	CAGCGGCAT	*	XA:Z:ref,+19,9M,0;\n",
+		"r004	256	ref	37	0	9M	*	0	0	CAGCGGCAT	*\n",
+		"r004	256	ref	47	0	9M	*	0	0	CAGCGGCAT	*\n",
+		"r004	0	ref	57	10	9M	*	0	0	CAGCGGCAT	*\n",
+		"r005	0	ref	67	0	9M	*	0	0	CAGCGGCAT	*\n",
+	}
+	// records are collected by two workers
+	gs := []*stats.GeneralStats{stats.NewGeneralStats(), stats.NewGeneralStats()}
+	for i, line := range lines {
+		sr, err := hts.NewReader(strings.NewReader(line))
+		checkTest(err, t)
+		r, err := sr.Read()
+		checkTest(err, t)
+		gs[i%2].Collect(sam.NewRecord(r))
+	}
+	gs[0].Update(gs[1])
+	gs[0].Finalize()
+	expected := stats.TagMap{0: 2, 1: 2, 2: 1}
+	if !reflect.DeepEqual(gs[0].Reads.Mapped, expected) {
+		t.Errorf("(Multimaps) Expected %v, got %v", expected, gs[0].Reads.Mapped)
+	}
+	if gs[0].Reads.Mappings.Count != uint64(len(lines)) {
+		t.Errorf("(Multimaps) Expected %d mappings, got %d", len(lines), gs[0].Reads.Mappings.Count)
+	}
+}
+
+func TestUniqueReads(t *testing.T) {
+	gtf := `chr1	test	gene	1001	5000	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	test	exon	1001	5000	.	+	.	gene_id "g1"; gene_type "protein_coding";
+`
+	index, err := annotation.CreateIndexFromReader(strings.NewReader(gtf), map[string]int{"chr1": 10000}, annotation.IndexOptions{})
+	checkTest(err, t)
+	// reads without NH or XA tags having a primary and a secondary alignment
+	records := `@SQ	SN:chr1	LN:10000
+r001	0	chr1	1101	60	50M	*	0	0	*	*
+r001	256	chr1	3001	0	50M	*	0	0	*	*
+r002	0	chr1	1201	0	50M	*	0	0	*	*
+r002	256	chr1	3101	0	50M	*	0	0	*	*
+r003	0	chr1	1301	60	50M	*	0	0	*	*	NH:i:2
+r003	256	chr1	3201	0	50M	*	0	0	*	*	NH:i:2
+`
+	sr, err := hts.NewReader(strings.NewReader(records))
+	checkTest(err, t)
+	general := stats.NewGeneralStats()
+	coverage := stats.NewCoverageStats(index, true)
+	for {
+		r, err := sr.Read()
+		if err != nil {
+			break
+		}
+		general.Collect(sam.NewRecord(r))
+		coverage.Collect(sam.NewRecord(r))
+	}
+	general.Finalize()
+	coverage.Finalize()
+	if u := general.Reads.Unique(); u != 1 {
+		t.Errorf("(UniqueReads) Expected 1 unique read in general stats, got %d", u)
+	}
+	if u := coverage.Total[stats.Total]; u != general.Reads.Unique() {
+		t.Errorf("(UniqueReads) Expected %d unique reads in coverageUniq, got %d", general.Reads.Unique(), u)
+	}
+}
+
+func TestChimeric(t *testing.T) {
+	records := `@SQ	SN:chr1	LN:100000000
+@SQ	SN:chr2	LN:100000000
+r001	65	chr1	100	60	10M	chr2	500	0	ACGTACGTAC	*
+r001	129	chr2	500	60	10M	chr1	100	0	ACGTACGTAC	*
+r002	99	chr1	100	60	10M	=	300	210	ACGTACGTAC	*
+r002	147	chr1	300	60	10M	=	100	-210	ACGTACGTAC	*
+r003	97	chr1	1000	60	10M	=	51000	50010	ACGTACGTAC	*
+r003	145	chr1	51000	60	10M	=	1000	-50010	ACGTACGTAC	*
+r004	0	chr1	1000	60	5M5S	*	0	0	ACGTACGTAC	*	SA:Z:chr1,1500,+,5S5M,60,0;
+r004	2048	chr1	1500	60	5H5M	*	0	0	ACGTA	*	SA:Z:chr1,1000,+,5M5S,60,0;
+r005	0	chr1	1000	60	5M5S	*	0	0	ACGTACGTAC	*	SA:Z:chr2,1000,+,5S5M,60,0;
+r005	2048	chr2	1000	60	5H5M	*	0	0	ACGTA	*	SA:Z:chr1,1000,+,5M5S,60,0;
+r006	4	*	0	0	*	*	0	0	ACGTACGTAC	*
+`
+	sr, err := hts.NewReader(strings.NewReader(records))
+	checkTest(err, t)
+	cs := stats.NewChimericStats()
+	for {
+		r, err := sr.Read()
+		if err != nil {
+			break
+		}
+		cs.Collect(sam.NewRecord(r))
+	}
+	cs.Finalize()
+	expected := stats.ChimericStats{
+		Supplementary: 2,
+		Reads: stats.ChimeraStats{Mapped: 8, Chimeric: 2, Fraction: 0.25, IntraChromosomal: 1, InterChromosomal: 1,
+			Distances: stats.DistanceStats{Under1k: 1}},
+		Pairs: stats.ChimeraStats{Mapped: 3, Chimeric: 2, Fraction: 2.0 / 3, IntraChromosomal: 1, InterChromosomal: 1,
+			Distances: stats.DistanceStats{Under100k: 1}},
+	}
+	if !reflect.DeepEqual(*cs, expected) {
+		t.Errorf("(Chimeric) Expected %+v, got %+v", expected, *cs)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	cfg := config.NewConfig(runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+	cfg.Filter = "uniq && mapq>=10"
+	out, err := ProcessWithConfig(bamFile, "", cfg)
+	checkTest(err, t)
+	general := out["general"].(*stats.GeneralStats)
+	if len(general.Reads.Mapped) != 1 || general.Reads.Mapped[1] == 0 {
+		t.Errorf("(Filter) Expected uniquely mapped reads only, got %v", general.Reads.Mapped)
+	}
+	cfg.Filter = "mapq>="
+	if _, err := ProcessWithConfig(bamFile, "", cfg); err == nil {
+		t.Error("(Filter) Expected error for an invalid filter")
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	for _, c := range []struct {
+		name, settings string
+		fail           bool
+	}{
+		{"config.yaml", `annotation: coverage-test.bed
+uniq: true
+max_mem: 64M
+stats: [general, coverage]
+`, false},
+		{"config.toml", `annotation = "coverage-test.bed"
+uniq = true
+max_mem = "64M"
+stats = ["general", "coverage"]
+`, false},
+		{"config.json", `{"annotation": "coverage-test.bed", "uniq": true, "max_mem": 67108864, "stats": ["general", "coverage"]}`, false},
+		{"unknown.yaml", `contigs: [chrM]
+`, true},
+		{"unknown.toml", `contigs = ["chrM"]
+`, true},
+	} {
+		dir, err := ioutil.TempDir("", "bamstats")
+		checkTest(err, t)
+		defer os.RemoveAll(dir)
+		// relative paths in the file are relative to its directory
+		bed, err := ioutil.ReadFile("data/coverage-test.bed")
+		checkTest(err, t)
+		checkTest(ioutil.WriteFile(filepath.Join(dir, "coverage-test.bed"), bed, 0644), t)
+		fileName := dir + "/" + c.name
+		checkTest(ioutil.WriteFile(fileName, []byte(c.settings), 0644), t)
+		cfg := config.NewConfig(runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+		cfg.ChrAliases = "data/aliases.tsv"
+		err = config.Load(fileName, cfg)
+		if c.fail {
+			if err == nil {
+				t.Errorf("(Load) %s: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("(Load) %s: unexpected error: %s", c.name, err)
+		}
+		if cfg.MaxMem != 64<<20 || cfg.MaxBuf != maxBuf || cfg.BiotypeTag != "gene_type" {
+			t.Errorf("(Load) %s: unexpected settings %+v", c.name, cfg)
+		}
+		if cfg.Annotation != filepath.Join(dir, "coverage-test.bed") || cfg.ChrAliases != "data/aliases.tsv" || cfg.QC != "" {
+			t.Errorf("(Load) %s: unexpected paths %+v", c.name, cfg)
+		}
+		cfg.ChrAliases = ""
+		out, err := Run(context.Background(), Options{Config: cfg, Input: bamFile})
+		checkTest(err, t)
+		for _, name := range []string{"general", "coverage", "coverageUniq"} {
+			if _, ok := out[name]; !ok {
+				t.Errorf("(Run) %s: missing %s stats", c.name, name)
+			}
+		}
+		if _, ok := out["rnaseq"]; ok {
+			t.Errorf("(Run) %s: unexpected rnaseq stats", c.name)
+		}
+		if anno := out["meta"].(*stats.Meta).Annotation; anno != cfg.Annotation {
+			t.Errorf("(Run) %s: expected annotation %s, got %s", c.name, cfg.Annotation, anno)
+		}
+	}
+}
+
+func TestOutputHTML(t *testing.T) {
+	var b bytes.Buffer
+	out, err := Process(bamFile, "data/coverage-test.gtf.gz", runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+	checkTest(err, t)
+	if err := out.OutputHTML(&b, "test <report>"); err != nil {
+		t.Fatalf("(OutputHTML) unexpected error: %s", err)
+	}
+	html := b.String()
+	for _, s := range []string{"<title>test &lt;report&gt;</title>", "Multimapping reads", "Insert sizes", "Genomic elements", "RNA-seq fractions"} {
+		if !strings.Contains(html, s) {
+			t.Errorf("(OutputHTML) %q not found in the report", s)
+		}
+	}
+	if n := strings.Count(html, "<svg"); n != 4 {
+		t.Errorf("(OutputHTML) expected 4 charts, got %d", n)
+	}
+	for _, s := range []string{"<script", "<link", "src="} {
+		if strings.Contains(html, s) {
+			t.Errorf("(OutputHTML) report is not self-contained: %q found", s)
+		}
+	}
+}
+
+type recordCount struct {
+	Records uint64 `json:"records"`
+}
+
+func (s *recordCount) Type() string                  { return "records" }
+func (s *recordCount) Update(other stats.Stats)      { s.Records += other.(*recordCount).Records }
+func (s *recordCount) Merge(others chan stats.Stats) {}
+func (s *recordCount) Collect(record *sam.Record)    { s.Records++ }
+func (s *recordCount) Finalize()                     {}
+
+type failingStats struct {
+	recordCount
+}
+
+func (s *failingStats) Collect(record *sam.Record) { panic("collector failure") }
+
+func TestStatsSelection(t *testing.T) {
+	stats.Register("records", func(index *annotation.RtreeMap, cfg *config.Config) stats.Stats {
+		return &recordCount{}
+	}, false)
+	cfg := config.NewConfig(runtime.GOMAXPROCS(-1), maxBuf, reads, true)
+	cfg.Stats = []string{"records", "coverage"}
+	out, err := ProcessWithConfig(bamFile, "data/coverage-test.bed", cfg)
+	checkTest(err, t)
+	for _, k := range []string{"records", "coverage", "coverageUniq", "meta"} {
+		if _, ok := out[k]; !ok {
+			t.Errorf("(StatsSelection) Missing %s stats", k)
+		}
+	}
+	if len(out) != 4 {
+		t.Errorf("(StatsSelection) Expected StatsMap of length 4, got %d", len(out))
+	}
+	if n := out["records"].(*recordCount).Records; n == 0 {
+		t.Error("(StatsSelection) No records collected")
+	}
+	var b bytes.Buffer
+	out.OutputJSON(&b)
+	b.Truncate(b.Len() - 1)
+	b.WriteString(`,"unknown":{"a":1}}`)
+	m, err := stats.ReadJSON(&b)
+	if err != nil {
+		t.Fatalf("(StatsSelection) ReadJSON unexpected error: %s", err)
+	}
+	if r, ok := m["records"].(*recordCount); !ok || r.Records != out["records"].(*recordCount).Records {
+		t.Errorf("(StatsSelection) Registered stats not read back from JSON, got %v", m["records"])
+	}
+	if _, ok := m["unknown"]; ok || len(m) != len(out) {
+		t.Errorf("(StatsSelection) Expected unknown JSON section to be skipped, got %d stats", len(m))
+	}
+	for _, names := range [][]string{{"general", "unknown"}, {"rnaseq"}} {
+		cfg.Stats = names
+		if _, err := ProcessWithConfig(bamFile, "", cfg); err == nil {
+			t.Errorf("(StatsSelection) Expected error for %v", names)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	annotationFile := "data/coverage-test.bed"
+	expected, err := Process(bamFile, annotationFile, runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+	checkTest(err, t)
+	bamData, err := ioutil.ReadFile(bamFile)
+	checkTest(err, t)
+	annoData, err := ioutil.ReadFile(annotationFile)
+	checkTest(err, t)
+	cfg := config.NewConfig(runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+	out, err := Run(context.Background(), Options{
+		Config:           cfg,
+		InputReader:      bytes.NewReader(bamData),
+		AnnotationReader: bytes.NewReader(annoData),
+		Collectors: []stats.Constructor{func(index *annotation.RtreeMap, cfg *config.Config) stats.Stats {
+			return &recordCount{}
+		}},
+	})
+	checkTest(err, t)
+	var a, b bytes.Buffer
+	stats.NewMap(expected["coverage"]).OutputJSON(&a)
+	stats.NewMap(out["coverage"]).OutputJSON(&b)
+	if a.String() != b.String() {
+		t.Error("(Run) CoverageStats are different")
+	}
+	if _, ok := out["records"]; !ok {
+		t.Error("(Run) Missing custom collector stats")
+	}
+
+	index, err := annotation.CreateIndexWithOptions(annotationFile, ChrLens(bamFile), annotation.IndexOptions{})
+	checkTest(err, t)
+	out, err = Run(context.Background(), Options{Config: cfg, Input: bamFile, AnnotationIndex: index})
+	checkTest(err, t)
+	if _, ok := out["rnaseq"]; !ok {
+		t.Error("(Run) Missing rnaseq stats with a prebuilt index")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Run(ctx, Options{Config: cfg, Input: bamFile}); err != context.Canceled {
+		t.Errorf("(Run) Expected %v, got %v", context.Canceled, err)
+	}
+	if _, err := Run(context.Background(), Options{Config: cfg, Input: "data/missing.bam"}); err == nil {
+		t.Error("(Run) Expected error for a missing input file")
+	}
+	_, err = Run(context.Background(), Options{
+		Config: cfg,
+		Input:  bamFile,
+		Collectors: []stats.Constructor{func(index *annotation.RtreeMap, cfg *config.Config) stats.Stats {
+			return nil
+		}, func(index *annotation.RtreeMap, cfg *config.Config) stats.Stats {
+			return &failingStats{}
+		}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "collector failure") {
+		t.Errorf("(Run) Expected collector error, got %v", err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var reports []Progress
+	cfg := config.NewConfig(runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+	_, err := Run(context.Background(), Options{
+		Config:           cfg,
+		Input:            bamFile,
+		Progress:         func(p Progress) { reports = append(reports, p) },
+		ProgressInterval: time.Millisecond,
+	})
+	checkTest(err, t)
+	if len(reports) == 0 {
+		t.Fatal("(Progress) No progress reported")
+	}
+	last := reports[len(reports)-1]
+	if !last.Done {
+		t.Error("(Progress) Last report not done")
+	}
+	var records uint64
+	for _, r := range last.References {
+		records += r.Records
+	}
+	if last.Records == 0 || records != last.Records {
+		t.Errorf("(Progress) Expected %d records in references, got %d", last.Records, records)
+	}
+
+	p := Progress{Records: 25, Expected: 100, Elapsed: time.Second}
+	if p.Fraction() != 0.25 || p.Rate() != 25 || p.ETA() != 3*time.Second {
+		t.Errorf("(Progress) Unexpected fraction %v, rate %v or ETA %v", p.Fraction(), p.Rate(), p.ETA())
+	}
+}
+
+func TestSampling(t *testing.T) {
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		cfg := config.NewConfig(runtime.GOMAXPROCS(-1), maxBuf, reads, false)
+		cfg.Fraction = 0.1
+		cfg.Seed = 42
+		out, err := ProcessWithConfig(bamFile, "", cfg)
+		checkTest(err, t)
+		sampling := out["meta"].(*stats.Meta).Sampling
+		if sampling == nil {
+			t.Fatal("(Sampling) Missing sampling metadata")
+		}
+		if f := float64(sampling.Sampled) / float64(sampling.Records); f < 0.09 || f > 0.11 {
+			t.Errorf("(Sampling) Expected fraction close to 0.1, got %v", f)
+		}
+		var b bytes.Buffer
+		stats.NewMap(out["general"]).OutputJSON(&b)
+		outputs = append(outputs, b.String())
+	}
+	if outputs[0] != outputs[1] {
+		t.Error("(Sampling) Different stats with the same seed")
+	}
+}
+
+func TestFragments(t *testing.T) {
+	var outputs []string
+	for _, cpu := range []int{1, 4} {
+		cfg := config.NewConfig(cpu, maxBuf, reads, true)
+		cfg.Fragments = true
+		out, err := ProcessWithConfig(bamFile, "data/coverage-test.gtf.gz", cfg)
+		checkTest(err, t)
+		general := out["general"].(*stats.GeneralStats)
+		rnaseq := out["rnaseq"].(*stats.RNAseqStats)
+		if rnaseq.Fragments == nil {
+			t.Fatal("(Fragments) Missing fragment counts")
+		}
+		if f := rnaseq.Fragments.Total; f < general.Pairs.Total || f >= general.Reads.Total {
+			t.Errorf("(Fragments) Expected between %d and %d fragments, got %d", general.Pairs.Total, general.Reads.Total, f)
+		}
+		coverage := out["coverage"].(*stats.CoverageStats)
+		if c := coverage.Total[stats.Total]; c > rnaseq.Fragments.Total {
+			t.Errorf("(Fragments) Expected at most %d fragments in coverage, got %d", rnaseq.Fragments.Total, c)
+		}
+		var b bytes.Buffer
+		stats.NewMap(out["coverage"], out["coverageUniq"], out["rnaseq"]).OutputJSON(&b)
+		outputs = append(outputs, b.String())
+	}
+	if outputs[0] != outputs[1] {
+		t.Error("(Fragments) Different stats with different numbers of workers")
+	}
+
+	// buffered mates are part of the memory budget
+	cfg := config.NewConfig(1, maxBuf, reads, false)
+	cfg.Fragments = true
+	cfg.MaxMem = 256 << 10
+	if _, err := ProcessWithConfig(bamFile, "data/coverage-test.gtf.gz", cfg); err == nil || !strings.Contains(err.Error(), "--max-mem") {
+		t.Errorf("(Fragments) Expected a memory budget error, got %v", err)
+	}
+
+	// mates in different classes are counted once, in the class of their union
+	gtf := `chr1	test	gene	1001	5000	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	test	exon	1001	2000	.	+	.	gene_id "g1"; gene_type "protein_coding";
+chr1	test	exon	4001	5000	.	+	.	gene_id "g1"; gene_type "protein_coding";
+`
+	index, err := annotation.CreateIndexFromReader(strings.NewReader(gtf), map[string]int{"chr1": 10000}, annotation.IndexOptions{})
+	checkTest(err, t)
+	records := `@SQ	SN:chr1	LN:10000
+@SQ	SN:chr2	LN:10000
+r001	99	chr1	1101	60	50M	=	3001	1950	*	*
+r001	147	chr1	3001	60	50M	=	1101	-1950	*	*
+r002	97	chr1	1201	60	50M	chr2	101	0	*	*
+r002	145	chr2	101	60	50M	chr1	1201	0	*	*
+`
+	sr, err := hts.NewReader(strings.NewReader(records))
+	checkTest(err, t)
+	coverage := stats.NewFragmentCoverageStats(index, false)
+	for {
+		r, err := sr.Read()
+		if err != nil {
+			break
+		}
+		coverage.Collect(sam.NewRecord(r))
+	}
+	coverage.Finalize()
+	// mates on chromosomes missing from the annotation are classified with the other mate
+	for elem, n := range coverage.Total {
+		if exp := map[string]uint64{stats.ExonIntron: 1, stats.Exon: 1, stats.Total: 2}[elem]; n != exp {
+			t.Errorf("(Fragments) Expected an exonic_intronic and an exon fragment, got %d %s", n, elem)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.Join(cwd(t), "schema/bamstats.schema.json")))
+	if err != nil {
+		t.Fatalf("(Schema) cannot load schema: %s", err)
+	}
+	max := 0.5
+	for _, c := range []struct {
+		annotation          string
+		uniq, qc, fragments bool
+	}{
+		{"", false, false, false},
+		{"data/coverage-test.bed", true, false, false},
+		{"data/coverage-test.gtf.gz", false, true, false},
+		{"data/coverage-test.gtf.gz", true, false, true},
+	} {
+		var b bytes.Buffer
+		cfg := config.NewConfig(runtime.GOMAXPROCS(-1), maxBuf, reads, c.uniq)
+		cfg.Fragments = c.fragments
+		if c.fragments {
+			cfg.Stats = append([]string{"chimeric"}, stats.DefaultCollectors...)
+		}
+		out, err := ProcessWithConfig(bamFile, c.annotation, cfg)
+		checkTest(err, t)
+		if c.qc {
+			qc, err := stats.EvaluateQC(out, stats.Thresholds{
+				"rnaseq.metrics.fraction_intergenic": {Max: &max},
+				"rnaseq.metrics.missing":             {Min: &max},
+			})
+			checkTest(err, t)
+			out.Add(qc)
+		}
+		out.OutputJSON(&b)
+		res, err := schema.Validate(gojsonschema.NewBytesLoader(b.Bytes()))
+		if err != nil {
+			t.Fatalf("(Schema) validation error: %s", err)
+		}
+		for _, e := range res.Errors() {
+			t.Errorf("(Schema) annotation %q: %s", c.annotation, e)
+		}
+	}
+	res, err := schema.Validate(gojsonschema.NewStringLoader(`{"general": {"protocol": "PairedEnd"}, "coverage": {}}`))
+	checkTest(err, t)
+	if res.Valid() {
+		t.Error("(Schema) invalid document validated")
+	}
+}
+
+func cwd(t *testing.T) string {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
 func BenchmarkGeneral(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		Process(bamFile, "", runtime.GOMAXPROCS(-1), maxBuf, reads, false)
@@ -193,6 +991,20 @@ func dump(b bytes.Buffer, fname string) error {
 	return err
 }
 
+// readAnnotationStats reads the expected results for annotation dependent stats. Separate
+// results are used for GTF files since transcript elements like CDS and UTRs are not in BED files.
+func readAnnotationStats(key, annotationFile string, t *testing.T) []byte {
+	expected := expectedJSON[key]
+	if strings.Contains(annotationFile, ".gtf") {
+		expected = expectedJSON[key+"Gtf"]
+	}
+	b, err := json.MarshalIndent(map[string]interface{}{key: readJSON(expected, t)}, "", "\t")
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
 func readStats(keys []string, t *testing.T) []byte {
 	stats := make(map[string]interface{})
 	for _, k := range keys {
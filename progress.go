@@ -0,0 +1,138 @@
+package bamstats
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	hts "github.com/biogo/hts/sam"
+)
+
+// defaultProgressInterval is the interval between progress reports if not specified in the options
+const defaultProgressInterval = 5 * time.Second
+
+// Progress reports the number of records processed, overall and for each reference.
+type Progress struct {
+	// Records is the number of records processed.
+	Records uint64
+	// Expected is the number of mapped records in the BAM index, or 0 if not known.
+	Expected uint64
+	// Elapsed is the time elapsed since the start of the processing.
+	Elapsed time.Duration
+	// References reports the references with records processed or expected.
+	References []ReferenceProgress
+	// Done is true for the final report.
+	Done bool
+}
+
+// ReferenceProgress reports the number of records processed for a reference.
+type ReferenceProgress struct {
+	Name     string
+	Records  uint64
+	Expected uint64
+}
+
+// Fraction returns the fraction of the expected records processed, or 0 if not known.
+func (p Progress) Fraction() float64 {
+	return fractionOf(p.Records, p.Expected)
+}
+
+// Rate returns the number of records processed per second.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Records) / p.Elapsed.Seconds()
+}
+
+// ETA returns the estimated time left for processing the expected records, or 0 if not known.
+func (p Progress) ETA() time.Duration {
+	rate := p.Rate()
+	if p.Expected <= p.Records || rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(p.Expected-p.Records) / rate * float64(time.Second))
+}
+
+// Fraction returns the fraction of the expected records processed, or 0 if not known.
+func (p ReferenceProgress) Fraction() float64 {
+	return fractionOf(p.Records, p.Expected)
+}
+
+func fractionOf(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	if n > total {
+		return 1
+	}
+	return float64(n) / float64(total)
+}
+
+// progressTracker counts the processed records by reference ID. Counts are updated atomically
+// by the workers.
+type progressTracker struct {
+	start    time.Time
+	names    []string
+	expected []uint64
+	total    uint64
+	counts   []uint64
+}
+
+func newProgressTracker(refs []*hts.Reference, mapped []uint64, reads int) *progressTracker {
+	t := &progressTracker{
+		start:    time.Now(),
+		names:    make([]string, len(refs)),
+		expected: make([]uint64, len(refs)),
+		counts:   make([]uint64, len(refs)),
+	}
+	for _, ref := range refs {
+		t.names[ref.ID()] = ref.Name()
+	}
+	if len(mapped) == len(refs) {
+		copy(t.expected, mapped)
+		for _, n := range mapped {
+			t.total += n
+		}
+	}
+	if reads > -1 && uint64(reads) < t.total {
+		t.total = uint64(reads)
+	}
+	return t
+}
+
+func (t *progressTracker) add(record *hts.Record) {
+	if id := record.Ref.ID(); id >= 0 && id < len(t.counts) {
+		atomic.AddUint64(&t.counts[id], 1)
+	}
+}
+
+func (t *progressTracker) snapshot(done bool) Progress {
+	p := Progress{
+		Expected: t.total,
+		Elapsed:  time.Since(t.start),
+		Done:     done,
+	}
+	for id, name := range t.names {
+		n := atomic.LoadUint64(&t.counts[id])
+		p.Records += n
+		if n > 0 || t.expected[id] > 0 {
+			p.References = append(p.References, ReferenceProgress{name, n, t.expected[id]})
+		}
+	}
+	return p
+}
+
+// run calls report with a snapshot of the progress at each interval, until ctx is done.
+func (t *progressTracker) run(ctx context.Context, interval time.Duration, report func(Progress)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report(t.snapshot(false))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
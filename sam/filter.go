@@ -0,0 +1,484 @@
+package sam
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/biogo/hts/sam"
+)
+
+// Filter selects records with a boolean expression over their properties, e.g.
+// mapq>=10 && !duplicate && tag(NH)==1. Expressions combine flags, numeric and string
+// properties, tag values and literals with comparison operators (==, !=, <, <=, >, >=),
+// the logical operators !, && and ||, and parentheses. Comparisons with missing tags
+// are false, and a tag used as a condition is true if the record has it.
+type Filter struct {
+	expr string
+	eval func(*Record) value
+}
+
+// NewFilter returns a new Filter for the given expression. It returns nil if the
+// expression is empty, as all the records are selected.
+func NewFilter(expr string) (*Filter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	p := &parser{}
+	if err := p.lex(expr); err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", expr, err)
+	}
+	e, err := p.parseOr()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = p.errorf("unexpected %s", p.peek())
+	}
+	if err == nil && !e.isCondition() {
+		err = fmt.Errorf("expression is not a condition")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", expr, err)
+	}
+	return &Filter{expr, e.eval}, nil
+}
+
+// Match returns true if the record is selected by the filter. It is safe for concurrent use.
+func (f *Filter) Match(r *Record) bool {
+	return f.eval(r).truth()
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// FilterFields returns the names of the record properties that can be used in filters.
+func FilterFields() []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type kind int
+
+const (
+	kindMissing kind = iota
+	kindBool
+	kindNumber
+	kindString
+	// kindAny is the static type of tag values, only known for each record
+	kindAny
+)
+
+func (k kind) String() string {
+	return [...]string{"missing", "bool", "number", "string", "tag"}[k]
+}
+
+type value struct {
+	kind kind
+	b    bool
+	n    float64
+	s    string
+}
+
+func (v value) truth() bool {
+	if v.kind == kindBool {
+		return v.b
+	}
+	return v.kind != kindMissing
+}
+
+type expr struct {
+	kind kind
+	eval func(*Record) value
+}
+
+func (e expr) isCondition() bool {
+	return e.kind == kindBool || e.kind == kindAny
+}
+
+func flagField(flag sam.Flags) expr {
+	return boolField(func(r *Record) bool { return r.Flags&flag == flag })
+}
+
+func boolField(f func(*Record) bool) expr {
+	return expr{kindBool, func(r *Record) value { return value{kind: kindBool, b: f(r)} }}
+}
+
+func numberField(f func(*Record) float64) expr {
+	return expr{kindNumber, func(r *Record) value { return value{kind: kindNumber, n: f(r)} }}
+}
+
+func stringField(f func(*Record) string) expr {
+	return expr{kindString, func(r *Record) value { return value{kind: kindString, s: f(r)} }}
+}
+
+func refName(ref *sam.Reference) string {
+	if ref == nil {
+		return "*"
+	}
+	return ref.Name()
+}
+
+// fields are the record properties that can be used in filters. Positions are 1-based.
+var fields = map[string]expr{
+	"paired":        flagField(sam.Paired),
+	"proper_pair":   flagField(sam.ProperPair),
+	"unmapped":      flagField(sam.Unmapped),
+	"mate_unmapped": flagField(sam.MateUnmapped),
+	"reverse":       flagField(sam.Reverse),
+	"mate_reverse":  flagField(sam.MateReverse),
+	"read1":         flagField(sam.Read1),
+	"read2":         flagField(sam.Read2),
+	"secondary":     flagField(sam.Secondary),
+	"qcfail":        flagField(sam.QCFail),
+	"duplicate":     flagField(sam.Duplicate),
+	"supplementary": flagField(sam.Supplementary),
+	"primary":       boolField((*Record).IsPrimary),
+	"uniq":          boolField((*Record).IsUniq),
+	"split":         boolField((*Record).IsSplit),
+	"flag":          numberField(func(r *Record) float64 { return float64(r.Flags) }),
+	"mapq":          numberField(func(r *Record) float64 { return float64(r.MapQ) }),
+	"pos":           numberField(func(r *Record) float64 { return float64(r.Pos + 1) }),
+	"end":           numberField(func(r *Record) float64 { return float64(r.End()) }),
+	"mpos":          numberField(func(r *Record) float64 { return float64(r.MatePos + 1) }),
+	"tlen":          numberField(func(r *Record) float64 { return float64(r.TempLen) }),
+	"length": numberField(func(r *Record) float64 {
+		if r.Seq.Length > 0 {
+			return float64(r.Seq.Length)
+		}
+		_, l := r.Cigar.Lengths()
+		return float64(l)
+	}),
+	"nh":           tagExpr("NH"),
+	"multiplicity": numberField(func(r *Record) float64 { return float64(r.Multiplicity()) }),
+	"name":         stringField(func(r *Record) string { return r.Name }),
+	"ref":          stringField(func(r *Record) string { return refName(r.Ref) }),
+	"mate_ref":     stringField(func(r *Record) string { return refName(r.MateRef) }),
+	"cigar":        stringField(func(r *Record) string { return r.Cigar.String() }),
+}
+
+// tagExpr returns the expression for the value of the tag, which is missing if the record
+// does not have it.
+func tagExpr(name string) expr {
+	tag := []byte(name)
+	return expr{kindAny, func(r *Record) value {
+		aux, ok := r.Tag(tag)
+		if !ok {
+			return value{}
+		}
+		switch v := aux.Value().(type) {
+		case int8:
+			return value{kind: kindNumber, n: float64(v)}
+		case uint8:
+			if aux.Type() == 'A' {
+				return value{kind: kindString, s: string(v)}
+			}
+			return value{kind: kindNumber, n: float64(v)}
+		case int16:
+			return value{kind: kindNumber, n: float64(v)}
+		case uint16:
+			return value{kind: kindNumber, n: float64(v)}
+		case int32:
+			return value{kind: kindNumber, n: float64(v)}
+		case uint32:
+			return value{kind: kindNumber, n: float64(v)}
+		case float32:
+			return value{kind: kindNumber, n: float64(v)}
+		case string:
+			return value{kind: kindString, s: v}
+		default:
+			return value{kind: kindString, s: fmt.Sprint(v)}
+		}
+	}}
+}
+
+func constant(v value) expr {
+	return expr{v.kind, func(*Record) value { return v }}
+}
+
+func compare(op string, a, b value) bool {
+	if a.kind != b.kind || a.kind == kindMissing {
+		return false
+	}
+	var c int
+	switch a.kind {
+	case kindBool:
+		if a.b != b.b {
+			c = 1
+		}
+	case kindNumber:
+		switch {
+		case a.n < b.n:
+			c = -1
+		case a.n > b.n:
+			c = 1
+		}
+	case kindString:
+		c = strings.Compare(a.s, b.s)
+	}
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// operators are sorted so that the longest ones are matched first
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "-"}
+
+type parser struct {
+	tokens []token
+	next   int
+}
+
+func (p *parser) lex(s string) error {
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			p.tokens = append(p.tokens, token{tokenIdent, s[i:j], i})
+			i = j
+		case unicode.IsDigit(c) || c == '.':
+			j := i + 1
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, token{tokenNumber, s[i:j], i})
+			i = j
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(s[i+1:], s[i])
+			if j < 0 {
+				return fmt.Errorf("unterminated string at position %d", i+1)
+			}
+			p.tokens = append(p.tokens, token{tokenString, s[i+1 : i+1+j], i})
+			i += j + 2
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("unexpected character %q at position %d", c, i+1)
+			}
+			p.tokens = append(p.tokens, token{tokenOp, op, i})
+			i += len(op)
+		}
+	}
+	p.tokens = append(p.tokens, token{tokenEOF, "", len(s)})
+	return nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOp && t.text == op {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, args...), p.peek().pos+1)
+}
+
+func (p *parser) condition(e expr, op string) error {
+	if !e.isCondition() {
+		return p.errorf("%s operand of %s is not a condition", e.kind, op)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right expr
+		if right, err = p.parseAnd(); err != nil {
+			break
+		}
+		if err = p.condition(left, "||"); err == nil {
+			err = p.condition(right, "||")
+		}
+		l, r := left.eval, right.eval
+		left = boolField(func(rec *Record) bool { return l(rec).truth() || r(rec).truth() })
+	}
+	return left, err
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.accept("&&") {
+		var right expr
+		if right, err = p.parseUnary(); err != nil {
+			break
+		}
+		if err = p.condition(left, "&&"); err == nil {
+			err = p.condition(right, "&&")
+		}
+		l, r := left.eval, right.eval
+		left = boolField(func(rec *Record) bool { return l(rec).truth() && r(rec).truth() })
+	}
+	return left, err
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.accept("!") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return e, err
+		}
+		if err := p.condition(e, "!"); err != nil {
+			return e, err
+		}
+		return boolField(func(rec *Record) bool { return !e.eval(rec).truth() }), nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (expr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return left, err
+	}
+	t := p.peek()
+	if t.kind != tokenOp {
+		return left, nil
+	}
+	op := t.text
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next++
+	default:
+		return left, nil
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return right, err
+	}
+	if left.kind != kindAny && right.kind != kindAny && left.kind != right.kind {
+		return right, fmt.Errorf("cannot compare %s with %s at position %d", left.kind, right.kind, t.pos+1)
+	}
+	if (left.kind == kindBool || right.kind == kindBool) && op != "==" && op != "!=" {
+		return right, fmt.Errorf("invalid operator %s for bool at position %d", op, t.pos+1)
+	}
+	l, r := left.eval, right.eval
+	return boolField(func(rec *Record) bool { return compare(op, l(rec), r(rec)) }), nil
+}
+
+func (p *parser) parseOperand() (expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokenNumber:
+		p.next++
+		return parseNumber(t, 1)
+	case tokenString:
+		p.next++
+		return constant(value{kind: kindString, s: t.text}), nil
+	case tokenIdent:
+		p.next++
+		if p.accept("(") {
+			if t.text != "tag" {
+				return expr{}, fmt.Errorf("unknown function %s at position %d", t.text, t.pos+1)
+			}
+			name := p.peek()
+			if name.kind != tokenIdent || len(name.text) != 2 {
+				return expr{}, p.errorf("invalid tag name %s", name)
+			}
+			p.next++
+			if !p.accept(")") {
+				return expr{}, p.errorf("expected \")\", found %s", p.peek())
+			}
+			return tagExpr(name.text), nil
+		}
+		if e, ok := fields[t.text]; ok {
+			return e, nil
+		}
+		if t.text == "true" || t.text == "false" {
+			return constant(value{kind: kindBool, b: t.text == "true"}), nil
+		}
+		return expr{}, fmt.Errorf("unknown field %s at position %d", t.text, t.pos+1)
+	case tokenOp:
+		switch t.text {
+		case "(":
+			p.next++
+			e, err := p.parseOr()
+			if err != nil {
+				return e, err
+			}
+			if !p.accept(")") {
+				return e, p.errorf("expected \")\", found %s", p.peek())
+			}
+			return e, nil
+		case "-":
+			p.next++
+			if n := p.peek(); n.kind == tokenNumber {
+				p.next++
+				return parseNumber(n, -1)
+			}
+		}
+	}
+	return expr{}, p.errorf("unexpected %s", t)
+}
+
+func parseNumber(t token, sign float64) (expr, error) {
+	n, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		i, ierr := strconv.ParseInt(t.text, 0, 64)
+		if ierr != nil {
+			return expr{}, fmt.Errorf("invalid number %s at position %d", t.text, t.pos+1)
+		}
+		n = float64(i)
+	}
+	return constant(value{kind: kindNumber, n: sign * n}), nil
+}
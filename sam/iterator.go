@@ -1,11 +1,20 @@
 package sam
 
-import "github.com/biogo/hts/bam"
+import (
+	"sync/atomic"
+
+	"github.com/biogo/hts/bam"
+)
 
 type Iterator struct {
 	*bam.Iterator
 	MaxReads, Reads int
 	chr             string
+	start, end      int
+	sampler         *Sampler
+	// total, if not nil, counts the primary records read by all the iterators sharing it,
+	// which is then limited by MaxReads instead of Reads
+	total *int64
 }
 
 func NewIterator(br *bam.Reader, data *RefChunk, reads int) (*Iterator, error) {
@@ -13,26 +22,46 @@ func NewIterator(br *bam.Reader, data *RefChunk, reads int) (*Iterator, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Iterator{it, reads, 0, data.Ref.Name()}, nil
+	return &Iterator{it, reads, 0, data.Ref.Name(), data.Start, data.End, nil, nil}, nil
 }
 
 func (i *Iterator) Next() bool {
-	cont := true
 	for i.Iterator.Next() {
 		if i.chr != i.Record().Ref.Name() {
 			continue
 		}
-		if i.MaxReads >= 0 {
-			cont = (i.Reads < i.MaxReads)
+		// records spanning the window start are read with the previous window
+		if pos := i.Record().Pos; pos < i.start {
+			continue
+		} else if pos >= i.end {
+			return false
+		}
+		if i.sampler != nil && !i.sampler.Keep(i.Record().Name) {
+			continue
+		}
+		if i.MaxReads < 0 {
+			return true
 		}
-		if i.Record().IsPrimary() {
-			i.Reads++
+		if !i.Record().IsPrimary() {
+			return i.read() < i.MaxReads
 		}
-		return cont
+		i.Reads++
+		if i.total != nil {
+			return atomic.AddInt64(i.total, 1) <= int64(i.MaxReads)
+		}
+		return i.Reads <= i.MaxReads
 	}
 	return false
 }
 
+// read returns the number of primary records read
+func (i *Iterator) read() int {
+	if i.total != nil {
+		return int(atomic.LoadInt64(i.total))
+	}
+	return i.Reads
+}
+
 func (i *Iterator) Record() *Record {
 	return NewRecord(i.Iterator.Record())
 }
@@ -1,14 +1,31 @@
 package sam
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"math"
 	"os"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/biogo/hts/bam"
 	"github.com/biogo/hts/bgzf"
+	"github.com/biogo/hts/bgzf/index"
 	"github.com/biogo/hts/sam"
 	"github.com/guigolab/bamstats/config"
+	"github.com/guigolab/bamstats/utils"
+)
+
+const (
+	// windowsPerWorker is the number of reference windows per worker, for balancing the work
+	windowsPerWorker = 4
+	// minWindowLen is the minimum length of a reference window
+	minWindowLen = 1 << 20
+	// recordMem is the estimated memory used by a buffered record
+	recordMem = 1 << 10
+	// decompressorMem is the estimated memory used by a BGZF decompressor,
+	// holding a compressed and a decompressed block
+	decompressorMem = 1 << 17
 )
 
 type Reader struct {
@@ -20,42 +37,103 @@ type Reader struct {
 	Channels []interface{}
 	cfg      *config.Config
 	unmapped uint64
+	src      io.ReaderAt
+	procs    int
+	closer   io.Closer
+	mapped   []uint64
+	sampler  *Sampler
+	filter   *Filter
 }
 
+// NewReader returns a new Reader for the BAM file. The BAM index, if present at the
+// same path with the .bai extension, is used for reading the references concurrently
+// and for getting the number of mapped records of each reference.
 func NewReader(bamFile string, cfg *config.Config) (*Reader, error) {
-	r, err := NewBamReader(bamFile, cfg)
+	f, err := os.Open(bamFile)
+	if err != nil {
+		return nil, err
+	}
+	var index io.Reader
+	if i, err := os.Open(bamFile + ".bai"); err == nil {
+		log.Infof("Opening BAM index %s", bamFile+".bai")
+		defer i.Close()
+		index = i
+	}
+	r, err := NewReaderFrom(f, index, cfg)
 	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.FileName = bamFile
+	r.closer = f
+	return r, nil
+}
+
+// NewReaderFrom returns a new Reader for the BAM data read from in. If index is not nil
+// and in implements io.ReaderAt, the BAM index read from index is used for reading the
+// references concurrently. Otherwise the records are read sequentially from in.
+// The index, if not nil, provides the number of mapped records of each reference too.
+func NewReaderFrom(in io.Reader, index io.Reader, cfg *config.Config) (*Reader, error) {
+	src, _ := in.(io.ReaderAt)
+	indexed := index != nil && src != nil && cfg.Cpu > 1
+	maxBuf, rd, fits := bufferSizes(cfg, indexed)
+	if !fits {
+		log.Warnf("Memory budget %s too small for %d workers, using more memory", utils.FormatSize(uint64(cfg.MaxMem)), cfg.Cpu)
+	}
+	r, err := bam.NewReader(in, rd)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := NewFilter(cfg.Filter)
+	if err != nil {
+		r.Close()
 		return nil, err
 	}
 	h := r.Header()
-	index, unmapped := readIndex(bamFile, r, cfg.Cpu)
-	workers := cfg.Cpu
+	var bai *bam.Index
+	var unmapped uint64
+	var mapped []uint64
 	if index != nil {
-		nRefs := index.NumRefs()
-		if cfg.Cpu > nRefs {
-			log.WithFields(log.Fields{
-				"References": nRefs,
-			}).Warnf("Limiting the number of workers to the number of BAM references")
-			workers = nRefs
+		idx, err := readIndex(index)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		mapped = mappedCounts(idx, h.Refs())
+		if indexed {
+			bai = idx
+			unmapped, _ = idx.Unmapped()
+			if filter != nil && unmapped > 0 {
+				log.Warnf("Unmapped records are not read with the BAM index and cannot be filtered: %d unmapped records not counted", unmapped)
+			}
 		}
 	}
+	workers := cfg.Cpu
 	chans := make([]interface{}, workers)
-	for i := 0; i < workers; i++ {
-		if index == nil {
-			chans[i] = make(chan *Record, cfg.MaxBuf)
-		} else {
-			chans[i] = make(chan *Iterator, cfg.MaxBuf)
+	if bai == nil {
+		for i := 0; i < workers; i++ {
+			chans[i] = make(chan *Record, maxBuf)
+		}
+	} else {
+		// reference windows are read by the first available worker
+		iterators := make(chan *Iterator, workers)
+		for i := 0; i < workers; i++ {
+			chans[i] = iterators
 		}
 	}
 	return &Reader{
-		r,
-		bamFile,
-		workers,
-		index,
-		h.Refs(),
-		chans,
-		cfg,
-		unmapped,
+		Reader:   r,
+		Workers:  workers,
+		Index:    bai,
+		Refs:     h.Refs(),
+		Channels: chans,
+		cfg:      cfg,
+		unmapped: unmapped,
+		src:      src,
+		procs:    rd,
+		mapped:   mapped,
+		sampler:  NewSampler(cfg.Fraction, cfg.Seed),
+		filter:   filter,
 	}, nil
 }
 
@@ -68,46 +146,155 @@ func NewBamReader(bamFile string, cfg *config.Config) (*bam.Reader, error) {
 	return r, err
 }
 
-func readIndex(bamFile string, br *bam.Reader, cpu int) (*bam.Index, uint64) {
-	if _, err := os.Stat(bamFile + ".bai"); err == nil && cpu > 1 {
-		log.Infof("Opening BAM index %s", bamFile+".bai")
-		i, err := os.Open(bamFile + ".bai")
-		defer i.Close()
-		if err != nil {
-			panic(err)
+// bufferSizes returns the number of records buffered for each worker and the number of
+// decompressors of each BAM reader. If cfg has a memory budget, they are reduced to fit
+// the budget, with at most a quarter of it used for decompression. In indexed mode, records
+// are not buffered and the windows are decompressed concurrently by the workers, so the
+// BAM reader, used for the header, and each reference window iterator have a single
+// decompressor: one for each worker, one for each iterator queued in the worker channel
+// and one being queued.
+// In fragment mode, half of the budget is left for the mates buffered by the statistics.
+// It reports whether the budget can be met, as at least one record is buffered and one
+// decompressor is used.
+func bufferSizes(cfg *config.Config, indexed bool) (maxBuf, rd int, fits bool) {
+	maxBuf, rd, fits = cfg.MaxBuf, cfg.Cpu, true
+	if indexed {
+		rd = 1
+	}
+	if cfg.MaxMem <= 0 {
+		return
+	}
+	budget := int64(cfg.MaxMem)
+	if cfg.Fragments {
+		// the other half is left for the mates buffered by the stats
+		budget /= 2
+	}
+	rd = utils.Max(utils.Min(rd, int(budget/4/decompressorMem)), 1)
+	decompressors := rd
+	if indexed {
+		decompressors += 2*cfg.Cpu + 1
+	}
+	avail := budget - int64(decompressors*decompressorMem)
+	if indexed {
+		fits = avail >= 0
+	} else {
+		fits = avail >= int64(cfg.Cpu)*recordMem
+		maxBuf = utils.Max(utils.Min(maxBuf, int(avail/int64(cfg.Cpu)/recordMem)), 1)
+	}
+	log.WithFields(log.Fields{
+		"MaxMem":        utils.FormatSize(uint64(cfg.MaxMem)),
+		"Buffer":        maxBuf,
+		"Decompressors": decompressors,
+	}).Debug("Sizing buffers to the memory budget")
+	return
+}
+
+func readIndex(in io.Reader) (*bam.Index, error) {
+	bai, err := bam.ReadIndex(in)
+	if err != nil {
+		return nil, fmt.Errorf("error reading BAM index: %v", err)
+	}
+	return bai, nil
+}
+
+func mappedCounts(bai *bam.Index, refs []*sam.Reference) []uint64 {
+	mapped := make([]uint64, len(refs))
+	for _, ref := range refs {
+		if ref.ID() >= bai.NumRefs() {
+			continue
 		}
-		bai, err := bam.ReadIndex(i)
-		if err != nil {
-			panic(err)
+		if stats, ok := bai.ReferenceStats(ref.ID()); ok {
+			mapped[ref.ID()] = stats.Mapped
 		}
-		unmapped, _ := bai.Unmapped()
-		return bai, unmapped
-	} else {
-		return nil, 0
 	}
+	return mapped
 }
 
-func (r *Reader) readChromosomes() error {
-	var err error
-	c := 0
+// windows splits the references into windows with about the same number of mapped records,
+// according to the BAM index, for balancing the work across the workers.
+func (r *Reader) windows() ([]*RefChunk, error) {
+	var total uint64
 	for _, ref := range r.Refs {
+		if ref.ID() < r.Index.NumRefs() {
+			if refStats, ok := r.Index.ReferenceStats(ref.ID()); ok {
+				total += refStats.Mapped
+			}
+		}
+	}
+	target := total / uint64(r.Workers*windowsPerWorker)
+	if target == 0 {
+		target = 1
+	}
+	var windows []*RefChunk
+	for _, ref := range r.Refs {
+		if ref.ID() >= r.Index.NumRefs() {
+			continue
+		}
 		refStats, ok := r.Index.ReferenceStats(ref.ID())
 		if !ok {
 			continue
 		}
-		refChunks := refStats.Chunk
-
-		r.Channels[c%r.Workers].(chan *Iterator) <- r.readChunk(NewRefChunk(ref, []bgzf.Chunk{refChunks}))
+		n := int((refStats.Mapped + target - 1) / target)
+		if max := (ref.Len() + minWindowLen - 1) / minWindowLen; n > max {
+			n = max
+		}
+		if n <= 1 {
+			windows = append(windows, NewRefChunk(ref, []bgzf.Chunk{refStats.Chunk}))
+			continue
+		}
+		size := (ref.Len() + n - 1) / n
+		for start := 0; start < ref.Len(); start += size {
+			end := start + size
+			if end > ref.Len() {
+				end = ref.Len()
+			}
+			chunks, err := r.Index.Chunks(ref, start, end)
+			if err == index.ErrInvalid {
+				// no records from start onwards
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error reading reference %s: %v", ref.Name(), err)
+			}
+			if len(chunks) > 0 {
+				windows = append(windows, &RefChunk{ref, chunks, start, end})
+			}
+		}
+	}
+	return windows, nil
+}
 
-		c++
+func (r *Reader) readChromosomes(ctx context.Context) error {
+	iterators := r.Channels[0].(chan *Iterator)
+	defer close(iterators)
+	windows, err := r.windows()
+	if err != nil {
+		return err
 	}
-	for i := 0; i < r.Workers; i++ {
-		close(r.Channels[i].(chan *Iterator))
+	// the records read from all the windows are limited together
+	total := new(int64)
+	for _, w := range windows {
+		it, err := r.readChunk(w, r.cfg.Reads)
+		if err != nil {
+			return err
+		}
+		it.total = total
+		select {
+		case iterators <- it:
+		case <-ctx.Done():
+			it.Close()
+			return ctx.Err()
+		}
 	}
-	return err
+	return nil
 }
 
-func (r *Reader) scan() error {
+func (r *Reader) scan(ctx context.Context) error {
+	defer func() {
+		for i := 0; i < r.Workers; i++ {
+			close(r.Channels[i].(chan *Record))
+		}
+	}()
 	c := 0
 	reads := r.cfg.Reads
 	for {
@@ -115,74 +302,156 @@ func (r *Reader) scan() error {
 			break
 		}
 		record, err := r.Reader.Read()
-		if err != nil {
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return fmt.Errorf("error reading BAM record: %v", err)
+		}
+		if r.sampler != nil && !r.sampler.Keep(record.Name) {
+			continue
+		}
 		rec := NewRecord(record)
 		if rec.IsUnmapped() {
-			r.unmapped++
+			// unmapped records are not sent to the workers, filter them here
+			if r.filter == nil || r.filter.Match(rec) {
+				r.unmapped++
+			}
 			continue
 		}
-		r.Channels[c%r.Workers].(chan *Record) <- rec
+		w := c % r.Workers
+		if r.cfg.Fragments {
+			// mates are sent to the same worker for pairing them
+			w = int(hash(rec.Name, 0) % uint64(r.Workers))
+		}
+		select {
+		case r.Channels[w].(chan *Record) <- rec:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 		if rec.IsPrimary() {
 			c++
 		}
 	}
-	for i := 0; i < r.Workers; i++ {
-		close(r.Channels[i].(chan *Record))
-	}
 	return nil
 }
 
+// Read reads the records and sends them to the worker channels, which are closed when done.
+// It panics on errors, use ReadContext for getting them.
 func (r *Reader) Read() {
+	if err := r.ReadContext(context.Background()); err != nil {
+		panic(err)
+	}
+}
+
+// ReadContext reads the records and sends them to the worker channels, which are closed when
+// done. Reading stops early if ctx is cancelled.
+func (r *Reader) ReadContext(ctx context.Context) error {
 	if r.Index == nil {
-		r.scan()
-	} else {
-		r.readChromosomes()
+		return r.scan(ctx)
 	}
+	return r.readChromosomes(ctx)
 }
 
-func (r *Reader) readChunk(data *RefChunk) *Iterator {
-	br, err := NewBamReader(r.FileName, r.cfg)
+func (r *Reader) readChunk(data *RefChunk, reads int) (*Iterator, error) {
+	br, err := bam.NewReader(io.NewSectionReader(r.src, 0, math.MaxInt64), r.procs)
 	if err != nil {
-		panic(err)
-	}
-	reads := -1
-	if r.cfg.Reads > -1 {
-		reads = r.cfg.Reads / len(r.Refs)
-		rem := r.cfg.Reads % len(r.Refs)
-		if data.Ref.ID() == 0 {
-			reads += rem
-		}
+		return nil, err
 	}
 	count, _ := r.Index.ReferenceStats(data.Ref.ID())
 	log.WithFields(log.Fields{
 		"Reference": data.Ref.Name(),
 		"Length":    data.Ref.Len(),
-		"Refs":      len(r.Refs),
+		"Start":     data.Start,
+		"End":       data.End,
 		"Reads":     reads,
 		"Mapped":    count.Mapped,
 		"Unmapped":  count.Unmapped,
 	}).Debugf("Reading reference")
 	it, err := NewIterator(br, data, reads)
 	if err != nil {
-		if err != io.EOF {
-			log.Println(err)
-		}
-		it.Close()
-		panic(err)
+		br.Close()
+		return nil, fmt.Errorf("error reading reference %s: %v", data.Ref.Name(), err)
 	}
-	return it
+	it.sampler = r.sampler
+	return it, nil
 }
 
+// Clone returns a new Reader for the same BAM file. It panics on errors, use CloneReader
+// for getting them.
 func (r *Reader) Clone() *Reader {
-	reader, err := NewReader(r.FileName, r.cfg)
+	reader, err := r.CloneReader()
 	if err != nil {
 		panic(err)
 	}
 	return reader
 }
 
+// CloneReader returns a new Reader for the same BAM file. It returns an error for
+// Readers created with NewReaderFrom.
+func (r *Reader) CloneReader() (*Reader, error) {
+	if r.FileName == "" {
+		return nil, fmt.Errorf("cannot clone a reader without a file name")
+	}
+	return NewReader(r.FileName, r.cfg)
+}
+
+// Unmapped returns the number of unmapped records. In indexed mode, the number of unmapped
+// records reported by the BAM index is scaled by the sampling fraction. As these records
+// are not read, none of them are reported in indexed mode if a filter is used.
 func (r *Reader) Unmapped() uint64 {
+	if r.filter != nil && r.Index != nil {
+		return 0
+	}
+	if r.sampler != nil && r.Index != nil {
+		return uint64(math.Round(float64(r.unmapped) * r.cfg.Fraction))
+	}
 	return r.unmapped
 }
+
+// Sampler returns the Sampler used for selecting the reads, or nil if all the reads are used.
+func (r *Reader) Sampler() *Sampler {
+	return r.sampler
+}
+
+// Filter returns the Filter used for selecting the records, or nil if all the records are used.
+func (r *Reader) Filter() *Filter {
+	return r.filter
+}
+
+// closeIterators closes the iterators queued in the worker channel and not read by the workers.
+func (r *Reader) closeIterators() {
+	iterators := r.Channels[0].(chan *Iterator)
+	for {
+		select {
+		case it, ok := <-iterators:
+			if !ok {
+				return
+			}
+			it.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Mapped returns the number of mapped records of each reference, indexed by reference ID,
+// as reported by the BAM index. It returns nil if the BAM index is not available.
+func (r *Reader) Mapped() []uint64 {
+	return r.mapped
+}
+
+// Close closes the Reader and the underlying BAM file, if opened by NewReader. In indexed
+// mode, the iterators left in the worker channel when reading stopped early are closed too.
+func (r *Reader) Close() error {
+	if r.Index != nil {
+		r.closeIterators()
+	}
+	err := r.Reader.Close()
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -1,6 +1,8 @@
 package sam
 
 import (
+	"strings"
+
 	"github.com/biogo/hts/sam"
 	"github.com/guigolab/bamstats/annotation"
 	"github.com/guigolab/bamstats/utils"
@@ -10,6 +12,11 @@ type Record struct {
 	*sam.Record
 }
 
+var (
+	nhTag = []byte("NH")
+	xaTag = []byte("XA")
+)
+
 // Export original sam.Record functions
 var (
 	NewTag = sam.NewTag
@@ -20,28 +27,53 @@ func NewRecord(r *sam.Record) *Record {
 	return &Record{r}
 }
 
+// IsUniq returns true if the read is uniquely mapped, i.e. its multiplicity is 1. It is the
+// rule used for unique reads by all the collectors.
 func (r *Record) IsUniq() bool {
-	NH, hasNH := r.Tag([]byte("NH"))
-	if !hasNH {
-		return false
+	return r.Multiplicity() == 1
+}
+
+// Multiplicity returns the number of alignments of the read. It is read from the NH tag or,
+// if missing, counted from the alternative hits listed in the XA tag, as written by BWA.
+// Supplementary alignments listed in the SA tag are parts of the same chimeric alignment,
+// so they do not change the multiplicity. Without NH and XA tags, it is 1 for primary
+// alignments with a positive mapping quality, as aligners set it to 0 for reads with
+// equally good alternative hits, and 0, i.e. unknown, otherwise.
+func (r *Record) Multiplicity() int {
+	if NH, ok := r.Tag(nhTag); ok {
+		switch v := NH.Value().(type) {
+		case int8:
+			return int(v)
+		case uint8:
+			return int(v)
+		case int16:
+			return int(v)
+		case uint16:
+			return int(v)
+		case int32:
+			return int(v)
+		case uint32:
+			return int(v)
+		case float32:
+			return int(v)
+		}
+		return 0
 	}
-	switch v := NH.Value().(type) {
-	case int8:
-		return v == 1
-	case uint8:
-		return v == 1
-	case int16:
-		return v == 1
-	case uint16:
-		return v == 1
-	case uint32:
-		return v == 1
-	case int32:
-		return v == 1
-	case float32:
-		return v == 1
+	if XA, ok := r.Tag(xaTag); ok {
+		n := 1
+		if hits, ok := XA.Value().(string); ok {
+			for _, hit := range strings.Split(hits, ";") {
+				if hit != "" {
+					n++
+				}
+			}
+		}
+		return n
 	}
-	return false
+	if r.IsPrimary() && r.MapQ > 0 {
+		return 1
+	}
+	return 0
 }
 
 func (r *Record) IsSplit() bool {
@@ -93,6 +125,10 @@ func (r *Record) IsQCFail() bool {
 	return r.Flags&sam.QCFail == sam.QCFail
 }
 
+func (r *Record) IsSupplementary() bool {
+	return r.Flags&sam.Supplementary == sam.Supplementary
+}
+
 func (r *Record) GetBlocks() []*annotation.Location {
 	blocks := make([]*annotation.Location, 0, 10)
 	ref := r.Ref.Name()
@@ -5,11 +5,15 @@ import (
 	"github.com/biogo/hts/sam"
 )
 
+// RefChunk represents the BGZF chunks of a reference window. Only the records starting
+// within the window, from Start inclusive to End exclusive, are read from the chunks.
 type RefChunk struct {
-	Ref    *sam.Reference
-	Chunks []bgzf.Chunk
+	Ref        *sam.Reference
+	Chunks     []bgzf.Chunk
+	Start, End int
 }
 
+// NewRefChunk returns a new RefChunk for the whole reference.
 func NewRefChunk(ref *sam.Reference, chunk []bgzf.Chunk) *RefChunk {
-	return &RefChunk{ref, chunk}
+	return &RefChunk{ref, chunk, 0, ref.Len()}
 }
@@ -2,11 +2,17 @@ package sam
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
 	"testing"
 
 	"github.com/sirupsen/logrus"
+	"github.com/biogo/hts/bam"
 	"github.com/biogo/hts/sam"
 	"github.com/guigolab/bamstats/annotation"
+	"github.com/guigolab/bamstats/config"
 )
 
 func checkTest(err error, t *testing.T) {
@@ -132,3 +138,244 @@ func TestFlags(t *testing.T) {
 		}
 	}
 }
+
+func TestMultiplicity(t *testing.T) {
+	for i, s := range []struct {
+		line         string
+		multiplicity int
+		uniq         bool
+	}{
+		{"r001	0	ref	7	30	9M	*	0	0	CAGCGGCAT	*	NH:i:1\n", 1, true},
+		{"r002	0	ref	7	0	9M	*	0	0	CAGCGGCAT	*	NH:i:3\n", 3, false},
+		{"r003	0	ref	7	0	9M	*	0	0	CAGCGGCAT	*	XA:Z:ref,+19,9M,0;ref,-29,9M,1;\n", 3, false},
+		{"r004	0	ref	7	60	9M	*	0	0	CAGCGGCAT	*	SA:Z:ref,29,-,6H3M,17,0;\n", 1, true},
+		{"r005	0	ref	7	0	9M	*	0	0	CAGCGGCAT	*\n", 0, false},
+		{"r006	256	ref	17	60	9M	*	0	0	CAGCGGCAT	*\n", 0, false},
+		{"r007	0	ref	7	60	9M	*	0	0	CAGCGGCAT	*\n", 1, true},
+	} {
+		sr, err := sam.NewReader(bytes.NewReader([]byte(s.line)))
+		checkTest(err, t)
+		r, err := sr.Read()
+		checkTest(err, t)
+		rec := NewRecord(r)
+		if m := rec.Multiplicity(); m != s.multiplicity {
+			t.Errorf("(Multiplicity) [%d] %s: expected %d, got %d", i, r.Name, s.multiplicity, m)
+		}
+		if u := rec.IsUniq(); u != s.uniq {
+			t.Errorf("(IsUniq) [%d] %s: expected %v, got %v", i, r.Name, s.uniq, u)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var records []*Record
+	for _, line := range []string{
+		"r001	99	ref	7	30	8M2I4M1D3M	=	37	39	TTAGATAAAGGATACTG	*	NH:i:1	XS:A:+\n",
+		"r002	1024	ref	9	3	5S6M	*	0	0	GCCTAAGCTAA	*	NH:i:2	RG:Z:lib1\n",
+		"r003	256	ref	16	30	6M14N5M	*	0	0	ATAGCTTCAGC	*\n",
+	} {
+		sr, err := sam.NewReader(bytes.NewReader([]byte(line)))
+		checkTest(err, t)
+		r, err := sr.Read()
+		checkTest(err, t)
+		records = append(records, NewRecord(r))
+	}
+	for _, c := range []struct {
+		expr    string
+		matches [3]bool
+	}{
+		{"mapq>=10 && !duplicate && tag(NH)==1", [3]bool{true, false, false}},
+		{"duplicate || split", [3]bool{false, true, true}},
+		{"!(primary)", [3]bool{false, false, true}},
+		{"tag(NH)", [3]bool{true, true, false}},
+		{"!tag(NH) || nh>1", [3]bool{false, true, true}},
+		{"tag(NH)!=1", [3]bool{false, true, false}},
+		{"tag(RG)=='lib1'", [3]bool{false, true, false}},
+		{"tag(XS)==\"+\"", [3]bool{true, false, false}},
+		{"ref==\"ref\" && pos>7 && end<=40", [3]bool{false, true, true}},
+		{"length==17 || cigar=='6M14N5M'", [3]bool{true, false, true}},
+		{"paired && proper_pair && read1 && mate_reverse && tlen>-1", [3]bool{true, false, false}},
+		{"flag==0x400 || name<\"r002\"", [3]bool{true, true, false}},
+		{"uniq == true", [3]bool{true, false, false}},
+	} {
+		f, err := NewFilter(c.expr)
+		if err != nil {
+			t.Errorf("(NewFilter) %s: unexpected error: %s", c.expr, err)
+			continue
+		}
+		for i, r := range records {
+			if m := f.Match(r); m != c.matches[i] {
+				t.Errorf("(Match) %s: expected %v for %s, got %v", c.expr, c.matches[i], r.Name, m)
+			}
+		}
+	}
+	if f, err := NewFilter(" "); f != nil || err != nil {
+		t.Errorf("(NewFilter) expected no filter for an empty expression, got %v, %v", f, err)
+	}
+	for _, expr := range []string{"mapq", "mapq>", "foo", "mapq>=\"a\"", "duplicate>true", "tag(NHX)", "count(NH)", "(mapq>1", "mapq>1)", "name=='x", "mapq>1 & split"} {
+		if _, err := NewFilter(expr); err == nil {
+			t.Errorf("(NewFilter) %s: expected error", expr)
+		}
+	}
+}
+
+func TestSampler(t *testing.T) {
+	for _, f := range []float64{0, 1, 1.5} {
+		if NewSampler(f, 0) != nil {
+			t.Errorf("(Sampler) expected no sampler for fraction %v", f)
+		}
+	}
+	n := 100000
+	for _, fraction := range []float64{0.1, 0.5} {
+		s, other := NewSampler(fraction, 42), NewSampler(fraction, 42)
+		kept := 0
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("read%d", i)
+			keep := s.Keep(name)
+			if keep != other.Keep(name) {
+				t.Fatalf("(Sampler) different selection for %s with the same seed", name)
+			}
+			if keep {
+				kept++
+			}
+		}
+		if s.Records() != uint64(n) || s.Kept() != uint64(kept) {
+			t.Errorf("(Sampler) expected %d records and %d kept, got %d and %d", n, kept, s.Records(), s.Kept())
+		}
+		if got := float64(kept) / float64(n); math.Abs(got-fraction) > 0.01 {
+			t.Errorf("(Sampler) expected fraction %v, got %v", fraction, got)
+		}
+	}
+	a, b := NewSampler(0.5, 1), NewSampler(0.5, 2)
+	same := 0
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("read%d", i)
+		if a.Keep(name) == b.Keep(name) {
+			same++
+		}
+	}
+	if same > 600 {
+		t.Errorf("(Sampler) selections with different seeds too similar: %d out of 1000", same)
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	for i, c := range []struct {
+		cpu, maxBuf   int
+		maxMem        config.Size
+		indexed       bool
+		fragments     bool
+		buffer, procs int
+		fits          bool
+	}{
+		{4, 1000000, 0, false, false, 1000000, 4, true},
+		{4, 1000, 1 << 30, false, false, 1000, 4, true},
+		{4, 1000000, 64 << 20, false, false, 16256, 4, true},
+		{16, 1000000, 1 << 20, false, false, 48, 2, true},
+		{4, 1000000, 0, true, false, 1000000, 1, true},
+		{16, 1000000, 1 << 20, true, false, 1000000, 1, false},
+		{16, 1000000, 34 << 17, true, false, 1000000, 1, true},
+		{16, 1000000, 34<<17 - 1, true, false, 1000000, 1, false},
+		{4, 1000000, 1 << 18, false, false, 32, 1, true},
+		{8, 1000000, 1 << 17, false, false, 1, 1, false},
+		{4, 1000000, 128 << 20, false, true, 16256, 4, true},
+	} {
+		cfg := config.NewConfig(c.cpu, c.maxBuf, -1, false)
+		cfg.MaxMem = c.maxMem
+		cfg.Fragments = c.fragments
+		buffer, procs, fits := bufferSizes(cfg, c.indexed)
+		if buffer != c.buffer || procs != c.procs || fits != c.fits {
+			t.Errorf("[%d] expected buffer %d, %d decompressors and fitting %v, got %d, %d and %v", i, c.buffer, c.procs, c.fits, buffer, procs, fits)
+		}
+	}
+}
+
+// indexedBAM returns a coordinate sorted BAM file, with its index, having n reads on chr1
+// and 10 reads on chr2.
+func indexedBAM(n int, t *testing.T) ([]byte, []byte) {
+	var sb bytes.Buffer
+	fmt.Fprintf(&sb, "@HD\tVN:1.5\tSO:coordinate\n@SQ\tSN:chr1\tLN:%d\n@SQ\tSN:chr2\tLN:1000000\n", 2048*n+1000)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "r%d\t0\tchr1\t%d\t60\t50M\t*\t0\t0\t*\t*\n", i, 2048*i+1)
+	}
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&sb, "s%d\t0\tchr2\t%d\t60\t50M\t*\t0\t0\t*\t*\n", i, 2048*i+1)
+	}
+	sr, err := sam.NewReader(&sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	bw, err := bam.NewWriter(&b, sr.Header(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		r, err := sr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bw.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	br, err := bam.NewReader(bytes.NewReader(b.Bytes()), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index bam.Index
+	for {
+		r, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := index.Add(r, br.LastChunk()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var bai bytes.Buffer
+	if err := bam.WriteIndex(&bai, &index); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes(), bai.Bytes()
+}
+
+func TestReadsLimit(t *testing.T) {
+	data, bai := indexedBAM(4000, t)
+	for _, reads := range []int{0, 1000, 4005, 5000} {
+		cfg := config.NewConfig(4, 1000, reads, false)
+		r, err := NewReaderFrom(bytes.NewReader(data), bytes.NewReader(bai), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errc := make(chan error, 1)
+		go func() {
+			errc <- r.ReadContext(context.Background())
+		}()
+		n := 0
+		for it := range r.Channels[0].(chan *Iterator) {
+			for it.Next() {
+				n++
+			}
+			it.Close()
+		}
+		checkTest(<-errc, t)
+		r.Close()
+		exp := reads
+		if exp > 4010 {
+			exp = 4010
+		}
+		if n != exp {
+			t.Errorf("(ReadsLimit) reads %d: expected %d records, got %d", reads, exp, n)
+		}
+	}
+}
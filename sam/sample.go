@@ -0,0 +1,68 @@
+package sam
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Sampler selects a fraction of the reads by hashing their names with a seed. The
+// selection is deterministic and all the records of a read, e.g. mates and multiple
+// mappings, are either kept or discarded together.
+type Sampler struct {
+	threshold uint64
+	seed      uint64
+	records   uint64
+	kept      uint64
+}
+
+// NewSampler returns a new Sampler keeping the given fraction of the reads. It returns
+// nil if fraction is not between 0 and 1, exclusive, as no sampling is needed.
+func NewSampler(fraction float64, seed int64) *Sampler {
+	if fraction <= 0 || fraction >= 1 {
+		return nil
+	}
+	return &Sampler{
+		threshold: uint64(fraction * math.MaxUint64),
+		seed:      uint64(seed),
+	}
+}
+
+// Keep returns true if the read with the given name is selected. It is safe for concurrent use.
+func (s *Sampler) Keep(name string) bool {
+	atomic.AddUint64(&s.records, 1)
+	if hash(name, s.seed) < s.threshold {
+		atomic.AddUint64(&s.kept, 1)
+		return true
+	}
+	return false
+}
+
+// Records returns the number of records seen by the Sampler.
+func (s *Sampler) Records() uint64 {
+	return atomic.LoadUint64(&s.records)
+}
+
+// Kept returns the number of records kept by the Sampler.
+func (s *Sampler) Kept() uint64 {
+	return atomic.LoadUint64(&s.kept)
+}
+
+// hash returns the 64-bit FNV-1a hash of name, starting from the seed, with the
+// splitmix64 finalizer applied for a uniform distribution of the high bits.
+func hash(name string, seed uint64) uint64 {
+	const (
+		offset = 14695981039346656037
+		prime  = 1099511628211
+	)
+	h := uint64(offset) ^ seed
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= prime
+	}
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,81 @@
+package stats
+
+import (
+	"sort"
+)
+
+// modes for counting reads overlapping genes with different biotypes
+const (
+	BiotypeAmbiguous = "ambiguous"
+	BiotypeAll       = "all"
+)
+
+// biotype special keys
+const (
+	Ambiguous = "ambiguous"
+	NoFeature = "no_feature"
+	Unknown   = "unknown"
+)
+
+var (
+	biotypeSpecialKeys = []string{
+		Ambiguous,
+		NoFeature,
+		Total,
+	}
+)
+
+// IsBiotypeMode returns true if mode is a valid mode for counting reads overlapping multiple biotypes.
+func IsBiotypeMode(mode string) bool {
+	return mode == BiotypeAmbiguous || mode == BiotypeAll
+}
+
+// BiotypeStats represents mapping statistics for gene biotypes
+type BiotypeStats map[string]uint64
+
+// Keys returns map keys, sorting biotypes alphabetically before the special keys.
+func (s BiotypeStats) Keys() []string {
+	var keys []string
+	for k := range s {
+		if !isBiotypeSpecialKey(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return append(keys, biotypeSpecialKeys...)
+}
+
+// Update updates all counts from another BiotypeStats instance.
+func (s BiotypeStats) Update(other BiotypeStats) {
+	for k := range other {
+		s[k] += other[k]
+	}
+}
+
+// MarshalJSON implements JSON Marshaller interface
+func (s BiotypeStats) MarshalJSON() ([]byte, error) {
+	return marshalOrdered(s.Keys(), func(k string) interface{} { return s[k] })
+}
+
+func isBiotypeSpecialKey(key string) bool {
+	for _, k := range biotypeSpecialKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func updateBiotypeCount(biotypes map[string]uint8, mode string, st BiotypeStats) {
+	st[Total]++
+	switch {
+	case len(biotypes) == 0:
+		st[NoFeature]++
+	case len(biotypes) == 1 || mode == BiotypeAll:
+		for bt := range biotypes {
+			st[bt]++
+		}
+	default:
+		st[Ambiguous]++
+	}
+}
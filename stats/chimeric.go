@@ -0,0 +1,187 @@
+package stats
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/guigolab/bamstats/sam"
+)
+
+// DistanceStats represents counts of intra-chromosomal chimeras by distance between their parts
+type DistanceStats struct {
+	Under1k   uint64 `json:"0-1k"`
+	Under10k  uint64 `json:"1k-10k"`
+	Under100k uint64 `json:"10k-100k"`
+	Under1M   uint64 `json:"100k-1M"`
+	AtLeast1M uint64 `json:"1M+"`
+}
+
+// ChimeraStats represents statistics for chimeric reads or discordant pairs
+type ChimeraStats struct {
+	Mapped           uint64        `json:"mapped"`
+	Chimeric         uint64        `json:"chimeric"`
+	Fraction         fraction      `json:"fraction"`
+	IntraChromosomal uint64        `json:"intra_chromosomal"`
+	InterChromosomal uint64        `json:"inter_chromosomal"`
+	Distances        DistanceStats `json:"distances"`
+}
+
+// ChimericStats represents statistics for chimeric reads, with supplementary alignments
+// listed in the SA tag, and for read pairs with discordant mates
+type ChimericStats struct {
+	Supplementary uint64       `json:"supplementary"`
+	Reads         ChimeraStats `json:"reads"`
+	Pairs         ChimeraStats `json:"pairs"`
+}
+
+// Type returns the type of stats
+func (s *ChimericStats) Type() string {
+	return "chimeric"
+}
+
+// Merge updates counts from a channel of Stats instances.
+func (s *ChimericStats) Merge(others chan Stats) {
+	for other := range others {
+		if other, ok := other.(*ChimericStats); ok {
+			s.Update(other)
+		}
+	}
+}
+
+// Update updates all counts from a Stats instance.
+func (s *ChimericStats) Update(other Stats) {
+	if other, ok := other.(*ChimericStats); ok {
+		s.Supplementary += other.Supplementary
+		s.Reads.Update(other.Reads)
+		s.Pairs.Update(other.Pairs)
+	}
+}
+
+// Finalize updates dependent counts of a Stats instance.
+func (s *ChimericStats) Finalize() {
+	s.Reads.UpdateFraction()
+	s.Pairs.UpdateFraction()
+}
+
+// Update updates all counts from another ChimeraStats instance.
+func (s *ChimeraStats) Update(other ChimeraStats) {
+	s.Mapped += other.Mapped
+	s.Chimeric += other.Chimeric
+	s.IntraChromosomal += other.IntraChromosomal
+	s.InterChromosomal += other.InterChromosomal
+	s.Distances.Update(other.Distances)
+	s.UpdateFraction()
+}
+
+// UpdateFraction updates the fraction of chimeric reads or pairs over the mapped ones.
+func (s *ChimeraStats) UpdateFraction() {
+	s.Fraction = 0
+	if s.Mapped > 0 {
+		s.Fraction = fraction(s.Chimeric) / fraction(s.Mapped)
+	}
+}
+
+// add counts a chimera with parts on the same chromosome at the given distance, or on
+// different chromosomes if the distance is negative.
+func (s *ChimeraStats) add(distance int) {
+	s.Chimeric++
+	if distance < 0 {
+		s.InterChromosomal++
+		return
+	}
+	s.IntraChromosomal++
+	s.Distances.add(distance)
+}
+
+// Update updates all counts from another DistanceStats instance.
+func (s *DistanceStats) Update(other DistanceStats) {
+	s.Under1k += other.Under1k
+	s.Under10k += other.Under10k
+	s.Under100k += other.Under100k
+	s.Under1M += other.Under1M
+	s.AtLeast1M += other.AtLeast1M
+}
+
+func (s *DistanceStats) add(distance int) {
+	switch {
+	case distance < 1e3:
+		s.Under1k++
+	case distance < 1e4:
+		s.Under10k++
+	case distance < 1e5:
+		s.Under100k++
+	case distance < 1e6:
+		s.Under1M++
+	default:
+		s.AtLeast1M++
+	}
+}
+
+// Collect collects chimeric statistics from a sam.Record. Supplementary alignments are
+// counted, while chimeric reads and discordant pairs are classified from the primary
+// alignment of the read and of the first mate respectively.
+func (s *ChimericStats) Collect(r *sam.Record) {
+	if r.IsUnmapped() || !r.IsPrimary() {
+		return
+	}
+	if r.IsSupplementary() {
+		s.Supplementary++
+		return
+	}
+	s.Reads.Mapped++
+	if SA, ok := r.Tag(saTag); ok {
+		if parts, ok := SA.Value().(string); ok {
+			s.Reads.add(chimeraDistance(r, parts))
+		}
+	}
+	if !r.IsPaired() || !r.IsRead1() || r.HasMateUnmapped() {
+		return
+	}
+	s.Pairs.Mapped++
+	if r.IsProperlyPaired() {
+		return
+	}
+	distance := -1
+	if r.MateRef != nil && r.Ref != nil && r.MateRef.Name() == r.Ref.Name() {
+		distance = abs(r.MatePos - r.Pos)
+	}
+	s.Pairs.add(distance)
+}
+
+var saTag = []byte("SA")
+
+// chimeraDistance returns the largest distance between the primary alignment of r and the
+// supplementary alignments listed in the SA tag (rname,pos,strand,CIGAR,mapQ,NM;), or -1 if
+// any of them is on a different chromosome.
+func chimeraDistance(r *sam.Record, parts string) int {
+	distance := 0
+	for _, part := range strings.Split(parts, ";") {
+		fields := strings.Split(part, ",")
+		if len(fields) < 2 {
+			continue
+		}
+		if r.Ref == nil || fields[0] != r.Ref.Name() {
+			return -1
+		}
+		pos, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		if d := abs(pos - 1 - r.Pos); d > distance {
+			distance = d
+		}
+	}
+	return distance
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// NewChimericStats creates a new instance of ChimericStats
+func NewChimericStats() *ChimericStats {
+	return &ChimericStats{}
+}
@@ -0,0 +1,184 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// shareSuffix is appended to the key of the derived statistics giving the share of the group total
+const shareSuffix = "_share"
+
+// Tolerance represents the maximum allowed difference for the statistics matching a path pattern
+type Tolerance struct {
+	Pattern  string
+	Value    float64
+	Relative bool
+}
+
+// ParseTolerance parses a tolerance in the form pattern=value, value being an absolute difference
+// or, if followed by '%', a relative difference. Patterns can contain wildcards, as in path.Match.
+func ParseTolerance(s string) (*Tolerance, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 1 {
+		return nil, fmt.Errorf("invalid tolerance %q: expected pattern=value", s)
+	}
+	t := &Tolerance{Pattern: s[:i]}
+	if _, err := path.Match(t.Pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid tolerance pattern %q: %v", t.Pattern, err)
+	}
+	v := s[i+1:]
+	if strings.HasSuffix(v, "%") {
+		t.Relative = true
+		v = strings.TrimSuffix(v, "%")
+	}
+	var err error
+	t.Value, err = strconv.ParseFloat(v, 64)
+	if err != nil || t.Value < 0 {
+		return nil, fmt.Errorf("invalid tolerance value %q", s[i+1:])
+	}
+	return t, nil
+}
+
+// String returns the string representation of a Tolerance
+func (t *Tolerance) String() string {
+	if t.Relative {
+		return fmt.Sprintf("%s=%g%%", t.Pattern, t.Value)
+	}
+	return fmt.Sprintf("%s=%g", t.Pattern, t.Value)
+}
+
+// Matches returns true if the statistic path matches the tolerance pattern
+func (t *Tolerance) Matches(p string) bool {
+	ok, _ := path.Match(t.Pattern, p)
+	return ok
+}
+
+// Difference represents the difference of a statistic between two Map instances
+type Difference struct {
+	Path      string
+	A, B      float64
+	InA, InB  bool
+	Tolerance *Tolerance
+}
+
+// Abs returns the absolute difference B - A
+func (d *Difference) Abs() float64 {
+	return d.B - d.A
+}
+
+// Rel returns the relative difference (B - A) / A
+func (d *Difference) Rel() float64 {
+	if d.A == 0 {
+		if d.B == 0 {
+			return 0
+		}
+		return math.Inf(int(math.Copysign(1, d.B)))
+	}
+	return (d.B - d.A) / math.Abs(d.A)
+}
+
+// Exceeds returns true if the statistic is missing from one of the Map instances or if
+// the difference is larger than its tolerance.
+func (d *Difference) Exceeds() bool {
+	if d.Tolerance == nil {
+		return false
+	}
+	if !d.InA || !d.InB {
+		return true
+	}
+	if d.Tolerance.Relative {
+		return math.Abs(d.Rel())*100 > d.Tolerance.Value
+	}
+	return math.Abs(d.Abs()) > d.Tolerance.Value
+}
+
+// Status returns FAIL if the difference exceeds its tolerance, OK if it does not and
+// an empty string if no tolerance applies.
+func (d *Difference) Status() string {
+	switch {
+	case d.Tolerance == nil:
+		return ""
+	case d.Exceeds():
+		return "FAIL"
+	default:
+		return "OK"
+	}
+}
+
+// Values returns the numeric statistics of sm by path, along with the paths in output order.
+// Metadata are not included.
+// For each group of statistics having a total, the share of each statistic in the total is
+// added with the _share suffix, e.g. coverage.total.exon_share.
+func (sm Map) Values() (map[string]float64, []string, error) {
+	rows, err := sm.Rows()
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make(map[string]float64)
+	var paths []string
+	totals := make(map[string]float64)
+	for _, r := range rows {
+		if r.Section == "meta" {
+			continue
+		}
+		v, err := strconv.ParseFloat(r.Value, 64)
+		if err != nil {
+			continue
+		}
+		p := r.Path()
+		values[p] = v
+		paths = append(paths, p)
+		if r.Key == Total {
+			totals[strings.TrimSuffix(p, "."+Total)] = v
+		}
+	}
+	for _, p := range paths {
+		i := strings.LastIndex(p, ".")
+		if i < 0 || p[i+1:] == Total {
+			continue
+		}
+		if total, ok := totals[p[:i]]; ok && total > 0 {
+			values[p+shareSuffix] = values[p] / total
+			paths = append(paths, p+shareSuffix)
+		}
+	}
+	return values, paths, nil
+}
+
+// Compare returns the differences of all the numeric statistics of a and b. The first
+// matching tolerance is assigned to each difference.
+func Compare(a, b Map, tolerances []*Tolerance) ([]*Difference, error) {
+	va, pa, err := a.Values()
+	if err != nil {
+		return nil, err
+	}
+	vb, pb, err := b.Values()
+	if err != nil {
+		return nil, err
+	}
+	var diffs []*Difference
+	add := func(p string) {
+		d := &Difference{Path: p}
+		d.A, d.InA = va[p]
+		d.B, d.InB = vb[p]
+		for _, t := range tolerances {
+			if t.Matches(p) {
+				d.Tolerance = t
+				break
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	for _, p := range pa {
+		add(p)
+	}
+	for _, p := range pb {
+		if _, inA := va[p]; !inA {
+			add(p)
+		}
+	}
+	return diffs, nil
+}
@@ -1,8 +1,7 @@
 package stats
 
 import (
-	"bytes"
-	"fmt"
+	"encoding/json"
 	"sort"
 
 	"github.com/guigolab/bamstats/annotation"
@@ -11,12 +10,15 @@ import (
 
 // general element constants
 const (
-	Exon       = "exon"
-	ExonIntron = "exonic_intronic"
-	Intergenic = "intergenic"
-	Intron     = "intron"
-	Other      = "others"
-	Total      = "total"
+	Exon          = "exon"
+	ExonIntron    = "exonic_intronic"
+	Intergenic    = "intergenic"
+	Intron        = "intron"
+	Other         = "others"
+	Total         = "total"
+	CDS           = "CDS"
+	FivePrimeUTR  = "five_prime_utr"
+	ThreePrimeUTR = "three_prime_utr"
 )
 
 var (
@@ -24,12 +26,52 @@ var (
 		ExonIntron,
 		Intron,
 		Exon,
+		CDS,
+		FivePrimeUTR,
+		ThreePrimeUTR,
 		Intergenic,
 		Other,
 		Total,
 	}
+	// codingElems lists transcript elements in order of precedence
+	codingElems = []string{
+		CDS,
+		FivePrimeUTR,
+		ThreePrimeUTR,
+	}
 )
 
+// elemKeys returns the genomic element keys of the given maps. Transcript elements are
+// included only if present in any of them, e.g. not for BED annotations without CDS.
+func elemKeys(maps ...ElementStats) []string {
+	var keys []string
+	for _, el := range allElems {
+		if isCodingElem(el) && !hasKey(el, maps...) {
+			continue
+		}
+		keys = append(keys, el)
+	}
+	return keys
+}
+
+func isCodingElem(el string) bool {
+	for _, c := range codingElems {
+		if el == c {
+			return true
+		}
+	}
+	return false
+}
+
+func hasKey(key string, maps ...ElementStats) bool {
+	for _, m := range maps {
+		if _, ok := m[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func getElemSet() map[string]struct{} {
 	elemSet := make(map[string]struct{})
 	for _, el := range allElems {
@@ -51,7 +93,7 @@ func (s ElementStats) Keys() []string {
 		}
 	}
 	sort.Strings(keys)
-	return append(keys, allElems...)
+	return append(keys, elemKeys(s)...)
 }
 
 // MergeKeys combine keys from two ElementsStats instances
@@ -71,7 +113,7 @@ func (s ElementStats) MergeKeys(other ElementStats) []string {
 		}
 	}
 	sort.Strings(keys)
-	return append(keys, allElems...)
+	return append(keys, elemKeys(s, other)...)
 }
 
 // CoverageStats represents genome coverage statistics for continuos, split and total mapped reads.
@@ -81,6 +123,7 @@ type CoverageStats struct {
 	Split      ElementStats `json:"split"`
 	Uniq       bool         `json:"-"`
 	index      *annotation.RtreeMap
+	fragments  *fragments
 }
 
 // Type returns the type of stats
@@ -97,7 +140,10 @@ func (s *CoverageStats) Update(other Stats) {
 	if other, ok := other.(*CoverageStats); ok {
 		s.Continuous.Update(other.Continuous)
 		s.Split.Update(other.Split)
-		s.Finalize()
+		if s.fragments != nil && other.fragments != nil {
+			s.fragments.update(other.fragments)
+		}
+		s.updateTotal()
 	}
 }
 
@@ -112,6 +158,21 @@ func (s *CoverageStats) Merge(others chan Stats) {
 
 // Finalize updates dependent counts of a CoverageStats instance.
 func (s *CoverageStats) Finalize() {
+	if s.fragments != nil {
+		s.fragments.flush()
+	}
+	if s.index != nil && s.index.HasElements(codingElems...) {
+		// report the transcript elements of the annotation even with no reads
+		for _, es := range []ElementStats{s.Continuous, s.Split} {
+			for _, el := range codingElems {
+				es[el] += 0
+			}
+		}
+	}
+	s.updateTotal()
+}
+
+func (s *CoverageStats) updateTotal() {
 	for _, elem := range s.Continuous.MergeKeys(s.Split) {
 		s.Total[elem] = s.Continuous[elem] + s.Split[elem]
 	}
@@ -126,23 +187,7 @@ func (s ElementStats) Update(other ElementStats) {
 
 // MarshalJSON implements JSON Marshaller interface
 func (s ElementStats) MarshalJSON() ([]byte, error) {
-	buf := &bytes.Buffer{}
-	buf.Write([]byte{'{', '\n'})
-	keys := s.Keys()
-	l := len(keys)
-	for i, k := range keys {
-		// TODO: write 0 values elements? Update test output in case
-		// if s[k] == 0 {
-		// 	continue
-		// }
-		fmt.Fprintf(buf, "\t\"%s\": %d", k, s[k])
-		if i < l-1 {
-			buf.WriteByte(',')
-		}
-		buf.WriteByte('\n')
-	}
-	buf.Write([]byte{'}', '\n'})
-	return buf.Bytes(), nil
+	return marshalOrdered(s.Keys(), func(k string) interface{} { return s[k] })
 }
 
 func updateCount(elems map[string]uint8, st ElementStats) {
@@ -164,6 +209,7 @@ func updateCount(elems map[string]uint8, st ElementStats) {
 
 	if hasExon && !hasIntron && exons > 0 {
 		st[Exon]++
+		updateCodingCount(elems, st)
 		return
 	}
 	if hasIntron && !hasExon && introns > 0 {
@@ -172,34 +218,82 @@ func updateCount(elems map[string]uint8, st ElementStats) {
 	}
 	if hasIntron && hasExon && introns > 0 && exons > 0 {
 		st[ExonIntron]++
+		updateCodingCount(elems, st)
 		return
 	}
 }
 
-// Collect collects genome coverage statistics from a sam.Record.
+// updateCodingCount counts exonic reads in the first overlapping transcript element
+// following the precedence CDS > 5'UTR > 3'UTR.
+func updateCodingCount(elems map[string]uint8, st ElementStats) {
+	for _, el := range codingElems {
+		if elems[el] > 0 {
+			st[el]++
+			return
+		}
+	}
+}
+
+// Collect collects genome coverage statistics from a sam.Record. In fragment mode, the
+// mates of paired reads are collected together when both are available.
 func (s *CoverageStats) Collect(record *sam.Record) {
 	if s.index == nil || !record.IsPrimary() || record.IsUnmapped() {
 		return
 	}
-	if s.Uniq && !record.IsUniq() {
+	if s.fragments != nil {
+		if !record.IsSupplementary() {
+			s.fragments.add(record)
+		}
 		return
 	}
+	s.collectFragment(record)
+}
+
+// collectFragment collects genome coverage statistics for the union of the blocks of the
+// given reads, which is split if any of the reads is split. Blocks on chromosomes missing
+// from the annotation are not used, and fragments with no such blocks are not counted.
+func (s *CoverageStats) collectFragment(reads ...*sam.Record) {
 	elements := map[string]uint8{}
-	for _, mappingLocation := range record.GetBlocks() {
-		rtree := s.index.Get(mappingLocation.Chrom())
-		if rtree == nil || rtree.Size() == 0 {
+	split := false
+	for _, record := range reads {
+		if s.Uniq && !record.IsUniq() {
 			return
 		}
-		results := annotation.QueryIndex(rtree, mappingLocation.Start(), mappingLocation.End())
-		mappingLocation.GetElements(results, elements)
+		indexed := false
+		for _, mappingLocation := range record.GetBlocks() {
+			rtree := s.index.Get(mappingLocation.Chrom())
+			if rtree == nil || rtree.Size() == 0 {
+				continue
+			}
+			indexed = true
+			results := annotation.QueryIndex(rtree, mappingLocation.Start(), mappingLocation.End())
+			mappingLocation.GetElements(results, elements)
+		}
+		split = split || indexed && record.IsSplit()
 	}
-	if record.IsSplit() {
+	if split {
 		updateCount(elements, s.Split)
 	} else {
 		updateCount(elements, s.Continuous)
 	}
 }
 
+// UnmarshalJSON parses a JSON representation of a CoverageStats instance.
+func (s *CoverageStats) UnmarshalJSON(b []byte) error {
+	type coverageStats CoverageStats
+	cs := coverageStats(*NewCoverageStats(nil, s.Uniq))
+	if err := json.Unmarshal(b, &cs); err != nil {
+		return err
+	}
+	*s = CoverageStats(cs)
+	for _, es := range []*ElementStats{&s.Total, &s.Continuous, &s.Split} {
+		if *es == nil {
+			*es = make(ElementStats)
+		}
+	}
+	return nil
+}
+
 // NewCoverageStats create a new instance of CoverageStats.
 func NewCoverageStats(index *annotation.RtreeMap, uniq bool) *CoverageStats {
 	return &CoverageStats{
@@ -210,3 +304,11 @@ func NewCoverageStats(index *annotation.RtreeMap, uniq bool) *CoverageStats {
 		index:      index,
 	}
 }
+
+// NewFragmentCoverageStats creates a new instance of CoverageStats counting fragments, with
+// the mates of paired reads classified as a unit.
+func NewFragmentCoverageStats(index *annotation.RtreeMap, uniq bool) *CoverageStats {
+	s := NewCoverageStats(index, uniq)
+	s.fragments = newFragments(s.Type(), s.collectFragment)
+	return s
+}
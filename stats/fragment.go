@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"fmt"
+
+	"github.com/guigolab/bamstats/sam"
+	log "github.com/sirupsen/logrus"
+)
+
+// fragments pairs the primary alignments of the mates of paired reads by read name, for
+// collecting statistics on fragments rather than reads. Mates may be collected by different
+// workers, so the unpaired ones are paired again when merging, and the ones left, e.g. with
+// the mate filtered out, are collected as single read fragments when finalizing.
+//
+// In coordinate sorted files, mates are buffered until the other mate is read, while mates
+// on different references are kept until finalizing. With a memory budget, collecting panics
+// when more than limit mates are buffered, which the workers report as an error. The peak
+// number of buffered mates is logged.
+type fragments struct {
+	name    string
+	mates   map[string]*sam.Record
+	peak    int
+	limit   int
+	collect func(reads ...*sam.Record)
+}
+
+// mateMem is the estimated memory used by a buffered mate, as by a record buffered by the reader
+const mateMem = 1 << 10
+
+func newFragments(name string, collect func(reads ...*sam.Record)) *fragments {
+	return &fragments{
+		name:    name,
+		mates:   make(map[string]*sam.Record),
+		collect: collect,
+	}
+}
+
+// add adds a read alignment, collecting its fragment when both mates are available. It
+// panics if the buffered mates exceed the limit.
+func (f *fragments) add(r *sam.Record) {
+	if !r.IsPaired() || r.HasMateUnmapped() {
+		f.collect(r)
+		return
+	}
+	if f.pair(r) {
+		return
+	}
+	if f.limit > 0 && len(f.mates) > f.limit {
+		panic(fmt.Errorf("%s: more than %d mates waiting for their pair in fragment mode, over the memory budget (increase --max-mem)", f.name, f.limit))
+	}
+	if len(f.mates) > f.peak {
+		f.peak = len(f.mates)
+	}
+}
+
+// pair collects the fragment of r if its mate is buffered, or buffers r otherwise. It
+// returns true if the fragment was collected.
+func (f *fragments) pair(r *sam.Record) bool {
+	if mate, ok := f.mates[r.Name]; ok {
+		delete(f.mates, r.Name)
+		f.collect(mate, r)
+		return true
+	}
+	f.mates[r.Name] = r
+	return false
+}
+
+// update pairs the unpaired mates of other. The peak is the largest one of a single worker.
+// The limit is not checked, as the mates of all the workers fit the memory budget.
+func (f *fragments) update(other *fragments) {
+	if other.peak > f.peak {
+		f.peak = other.peak
+	}
+	for _, r := range other.mates {
+		f.pair(r)
+	}
+	other.mates = make(map[string]*sam.Record)
+}
+
+// flush collects the unpaired mates as single read fragments.
+func (f *fragments) flush() {
+	log.WithFields(log.Fields{
+		"Stats":    f.name,
+		"Peak":     f.peak,
+		"Unpaired": len(f.mates),
+	}).Info("Buffered mates in fragment mode")
+	for _, r := range f.mates {
+		f.collect(r)
+	}
+	f.mates = make(map[string]*sam.Record)
+}
@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"encoding/json"
 	"math"
 
 	"github.com/guigolab/bamstats/sam"
@@ -8,10 +9,10 @@ import (
 
 // MappedReadsStats represents statistics for mapped reads
 type MappedReadsStats struct {
-	Total      uint64 `json:"total,omitempty"`
-	Unmapped   uint64 `json:"unmapped,omitempty"`
-	Mapped     TagMap `json:"mapped,omitempty"`
-	Duplicates uint64 `json:"duplicates,omitempty"`
+	Total      uint64 `json:"total"`
+	Unmapped   uint64 `json:"unmapped"`
+	Mapped     TagMap `json:"mapped"`
+	Duplicates uint64 `json:"duplicates"`
 }
 
 // MappingsStats represents statistics for mappings
@@ -23,7 +24,7 @@ type MappingsStats struct {
 // MappedPairsStats represents statistcs for mapped read-pairs
 type MappedPairsStats struct {
 	MappedReadsStats
-	InsertSizes TagMap `json:"insert_sizes,omitempty"`
+	InsertSizes TagMap `json:"insert_sizes"`
 }
 
 // MultimapStats represents statistics for multi-maps
@@ -35,8 +36,8 @@ type MultimapStats struct {
 // GeneralStats represents general mapping statistics
 type GeneralStats struct {
 	Protocol string           `json:"protocol"`
-	Reads    MappingsStats    `json:"reads,omitempty"`
-	Pairs    MappedPairsStats `json:"pairs,omitempty"`
+	Reads    MappingsStats    `json:"reads"`
+	Pairs    MappedPairsStats `json:"pairs"`
 }
 
 // Type returns the type of stats
@@ -110,14 +111,38 @@ func (s *MappedPairsStats) FilterInsertSizes(percent float64) {
 
 // UpdateMappingsRatio updates ration of mappings vs total mapped reads.
 func (s *MappingsStats) UpdateMappingsRatio() {
-	s.Mappings.Ratio = fraction(s.Mappings.Count) / fraction(s.Mapped.Total())
+	s.Mappings.Ratio = 0
+	if mapped := s.Mapped.Total(); mapped > 0 {
+		s.Mappings.Ratio = fraction(s.Mappings.Count) / fraction(mapped)
+	}
 }
 
-// Unique returns the number of uniquely mapped reads.
+// Unique returns the number of uniquely mapped reads, i.e. the reads counted with
+// multiplicity 1, as selected by sam.Record.IsUniq.
 func (s *MappedReadsStats) Unique() uint64 {
 	return s.Mapped[1]
 }
 
+// UnmarshalJSON parses a JSON representation of a GeneralStats instance.
+func (s *GeneralStats) UnmarshalJSON(b []byte) error {
+	type generalStats GeneralStats
+	gs := generalStats(*NewGeneralStats())
+	if err := json.Unmarshal(b, &gs); err != nil {
+		return err
+	}
+	*s = GeneralStats(gs)
+	if s.Reads.Mapped == nil {
+		s.Reads.Mapped = make(TagMap)
+	}
+	if s.Pairs.Mapped == nil {
+		s.Pairs.Mapped = make(TagMap)
+	}
+	if s.Pairs.InsertSizes == nil {
+		s.Pairs.InsertSizes = make(TagMap)
+	}
+	return nil
+}
+
 // NewGeneralStats creates a new instance of GeneralStats
 func NewGeneralStats() *GeneralStats {
 	ms := GeneralStats{}
@@ -149,18 +174,6 @@ func (s *GeneralStats) Collect(r *sam.Record) {
 			s.Protocol = "PairedEnd"
 		}
 	}
-	NH, hasNH := r.Tag([]byte("NH"))
-	if !hasNH {
-		t := sam.NewTag("NH")
-		NH, _ = sam.NewAux(t, 0)
-	}
-	var NHKey int
-	NHconv, ok := NH.Value().(uint8)
-	if ok {
-		NHKey = int(NHconv)
-	} else {
-		NHKey = int(NH.Value().(int8))
-	}
 	if r.IsUnmapped() {
 		s.Reads.Total++
 		s.Reads.Unmapped++
@@ -168,11 +181,12 @@ func (s *GeneralStats) Collect(r *sam.Record) {
 	}
 	s.Reads.Mappings.Count++
 	if r.IsPrimary() {
+		n := r.Multiplicity()
 		s.Reads.Total++
-		s.Reads.Mapped[NHKey]++
+		s.Reads.Mapped[n]++
 		if r.IsFirstOfValidPair() {
 			s.Pairs.Total++
-			s.Pairs.Mapped[NHKey]++
+			s.Pairs.Mapped[n]++
 			isLen := int(math.Abs(float64(r.TempLen)))
 			s.Pairs.InsertSizes[isLen]++
 		}
@@ -0,0 +1,143 @@
+package stats
+
+import (
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+)
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"value": func(v *float64) string {
+		if v == nil {
+			return "NA"
+		}
+		return formatValue(*v)
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em auto; max-width: 800px; color: #222; }
+h1 { font-size: 1.6em; }
+h2 { font-size: 1.2em; border-bottom: 1px solid #ccc; padding-bottom: 0.2em; margin-top: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.3em 1em; border-bottom: 1px solid #eee; text-align: left; }
+td.num { text-align: right; }
+.PASS { color: #2e7d32; } .WARN { color: #ef6c00; } .FAIL { color: #c62828; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{with .Summary}}<h2>Summary</h2>
+<table>{{range .}}<tr><th>{{.Name}}</th><td class="num">{{.Value}}</td></tr>{{end}}</table>{{end}}
+{{with .QC}}<h2>QC</h2>
+<p>Overall status: <strong class="{{.Status}}">{{.Status}}</strong></p>
+<table><tr><th>Metric</th><th>Value</th><th>Status</th></tr>{{range $p, $m := .Metrics}}
+<tr><td>{{$p}}</td><td class="num">{{value $m.Value}}</td><td class="{{$m.Status}}">{{$m.Status}}</td></tr>{{end}}</table>{{end}}
+{{range .Charts}}<h2>{{.Title}}</h2>
+{{.SVG}}
+{{end}}
+</body>
+</html>
+`))
+
+type htmlRow struct {
+	Name, Value string
+}
+
+type htmlChart struct {
+	Title string
+	SVG   template.HTML
+}
+
+type htmlReport struct {
+	Title   string
+	Summary []htmlRow
+	QC      *QCStats
+	Charts  []htmlChart
+}
+
+func sortedTagMap(tm TagMap) ([]int, []float64) {
+	var keys []int
+	for k := range tm {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	values := make([]float64, len(keys))
+	for i, k := range keys {
+		values[i] = float64(tm[k])
+	}
+	return keys, values
+}
+
+// OutputHTML writes sm to the writer as a self-contained HTML report with inline SVG charts.
+func (sm Map) OutputHTML(writer io.Writer, title string) error {
+	r := htmlReport{Title: title}
+	if g, ok := sm["general"].(*GeneralStats); ok {
+		mapped := g.Reads.Mapped.Total()
+		r.Summary = append(r.Summary,
+			htmlRow{"Protocol", g.Protocol},
+			htmlRow{"Reads", strconv.FormatUint(g.Reads.Total, 10)},
+			htmlRow{"Mapped reads", strconv.FormatUint(mapped, 10)},
+			htmlRow{"Uniquely mapped reads", strconv.FormatUint(g.Reads.Unique(), 10)},
+			htmlRow{"Duplicate reads", strconv.FormatUint(g.Reads.Duplicates, 10)},
+			htmlRow{"Mappings per mapped read", formatValue(float64(g.Reads.Mappings.Ratio))},
+		)
+		if g.Pairs.Total > 0 {
+			r.Summary = append(r.Summary, htmlRow{"Read pairs", strconv.FormatUint(g.Pairs.Total, 10)})
+		}
+		if len(g.Reads.Mapped) > 0 {
+			keys, values := sortedTagMap(g.Reads.Mapped)
+			labels := make([]string, len(keys))
+			for i, k := range keys {
+				labels[i] = strconv.Itoa(k)
+			}
+			r.Charts = append(r.Charts, htmlChart{"Multimapping reads", barChart(labels, []series{{"Mapped reads", values}}, "Reads")})
+		}
+		if len(g.Pairs.InsertSizes) > 0 {
+			keys, values := sortedTagMap(g.Pairs.InsertSizes)
+			xs := make([]float64, len(keys))
+			for i, k := range keys {
+				xs[i] = float64(k)
+			}
+			r.Charts = append(r.Charts, htmlChart{"Insert sizes", lineChart(xs, series{"Read pairs", values}, "Insert size (bp)", "Read pairs")})
+		}
+	}
+	for _, key := range []string{"coverage", "coverageUniq"} {
+		c, ok := sm[key].(*CoverageStats)
+		if !ok {
+			continue
+		}
+		var elems []string
+		elems = append(elems, coverageCategories...)
+		for _, el := range codingElems {
+			if hasKey(el, c.Continuous, c.Split) {
+				elems = append(elems, el)
+			}
+		}
+		continuous, split := make([]float64, len(elems)), make([]float64, len(elems))
+		for i, e := range elems {
+			continuous[i], split[i] = float64(c.Continuous[e]), float64(c.Split[e])
+		}
+		title := "Genomic elements"
+		if c.Uniq {
+			title += " (uniquely mapped reads)"
+		}
+		r.Charts = append(r.Charts, htmlChart{title, barChart(elems, []series{{"Continuous", continuous}, {"Split", split}}, "Reads")})
+	}
+	if rs, ok := sm["rnaseq"].(*RNAseqStats); ok && rs.Metrics != nil {
+		labels := []string{"mapped", "intergenic", "rRNA", "duplicates"}
+		values := []float64{float64(rs.Metrics.Mapped), float64(rs.Metrics.Intergenic), float64(rs.Metrics.RRNA), float64(rs.Metrics.Duplicates)}
+		for i := range values {
+			values[i] *= 100
+		}
+		r.Charts = append(r.Charts, htmlChart{"RNA-seq fractions", barChart(labels, []series{{"% of reads", values}}, "%")})
+	}
+	if qc, ok := sm["qc"].(*QCStats); ok {
+		r.QC = qc
+	}
+	return htmlTemplate.Execute(writer, r)
+}
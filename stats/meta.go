@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"time"
+
+	"github.com/guigolab/bamstats/config"
+	"github.com/guigolab/bamstats/sam"
+)
+
+// SchemaVersion is the version of the JSON output schema, see schema/bamstats.schema.json
+const SchemaVersion = "1.0"
+
+// Meta represents the metadata of a bamstats run
+type Meta struct {
+	Version       string         `json:"version"`
+	SchemaVersion string         `json:"schema_version"`
+	Input         string         `json:"input"`
+	Annotation    string         `json:"annotation"`
+	Parameters    *config.Config `json:"parameters"`
+	StartTime     time.Time      `json:"start_time"`
+	RunTime       float64        `json:"run_time"`
+	Sampling      *Sampling      `json:"sampling"`
+}
+
+// Sampling reports the records used when subsampling reads
+type Sampling struct {
+	Records  uint64   `json:"records"`
+	Sampled  uint64   `json:"sampled"`
+	Fraction fraction `json:"fraction"`
+}
+
+// NewSampling creates a new instance of Sampling with the effective fraction of sampled records.
+func NewSampling(records, sampled uint64) *Sampling {
+	s := &Sampling{Records: records, Sampled: sampled}
+	if records > 0 {
+		s.Fraction = fraction(float64(sampled) / float64(records))
+	}
+	return s
+}
+
+// Type returns the type of stats
+func (s *Meta) Type() string {
+	return "meta"
+}
+
+// Update does nothing, as metadata describe a single run.
+func (s *Meta) Update(other Stats) {}
+
+// Merge does nothing, as metadata describe a single run.
+func (s *Meta) Merge(others chan Stats) {}
+
+// Collect does nothing, as metadata describe a single run.
+func (s *Meta) Collect(record *sam.Record) {}
+
+// Finalize does nothing, as metadata describe a single run.
+func (s *Meta) Finalize() {}
+
+// NewMeta creates a new instance of Meta for a run started at the given time. The run time is
+// computed in seconds from the start time.
+func NewMeta(version, input, annotation string, cfg *config.Config, start time.Time) *Meta {
+	return &Meta{
+		Version:       version,
+		SchemaVersion: SchemaVersion,
+		Input:         input,
+		Annotation:    annotation,
+		Parameters:    cfg,
+		StartTime:     start.UTC().Truncate(time.Second),
+		RunTime:       time.Since(start).Seconds(),
+	}
+}
@@ -0,0 +1,264 @@
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MultiQC section identifiers
+const (
+	MultiQCGeneral     = "bamstats_general"
+	MultiQCCoverage    = "bamstats_coverage"
+	MultiQCMultimap    = "bamstats_multimap"
+	MultiQCInsertSizes = "bamstats_insert_sizes"
+)
+
+// coverageCategories are the exclusive genomic elements shown in the coverage bar graph
+var coverageCategories = []string{
+	Exon,
+	ExonIntron,
+	Intron,
+	Intergenic,
+	Other,
+}
+
+// MultiQCSection represents a MultiQC custom content section
+type MultiQCSection struct {
+	ID          string                 `json:"id"`
+	SectionName string                 `json:"section_name,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	PlotType    string                 `json:"plot_type"`
+	Pconfig     map[string]interface{} `json:"pconfig,omitempty"`
+	Headers     map[string]interface{} `json:"headers,omitempty"`
+	Data        map[string]interface{} `json:"data"`
+}
+
+// Output writes the section as a MultiQC custom content JSON file to the writer
+func (s *MultiQCSection) Output(writer io.Writer) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(b)
+	return err
+}
+
+// OutputTSV writes the section as a MultiQC custom content TSV file to the writer. Section
+// settings are written as YAML comment lines, followed by a table with a row for each sample.
+func (s *MultiQCSection) OutputTSV(writer io.Writer) error {
+	w := bufio.NewWriter(writer)
+	settings := []struct {
+		key   string
+		value interface{}
+	}{
+		{"id", s.ID},
+		{"section_name", s.SectionName},
+		{"description", s.Description},
+		{"plot_type", s.PlotType},
+		{"pconfig", s.Pconfig},
+		{"headers", s.Headers},
+	}
+	for _, setting := range settings {
+		if v, ok := setting.value.(string); ok && v == "" {
+			continue
+		}
+		if v, ok := setting.value.(map[string]interface{}); ok && len(v) == 0 {
+			continue
+		}
+		// JSON is valid YAML flow syntax
+		b, err := json.Marshal(setting.value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "# %s: %s\n", setting.key, b)
+	}
+	rows, err := s.rows()
+	if err != nil {
+		return err
+	}
+	var samples []string
+	columns := map[string]struct{}{}
+	for sample, row := range rows {
+		samples = append(samples, sample)
+		for k := range row {
+			columns[k] = struct{}{}
+		}
+	}
+	sort.Strings(samples)
+	header := sortedColumns(columns)
+	fmt.Fprintf(w, "Sample\t%s\n", strings.Join(header, "\t"))
+	for _, sample := range samples {
+		values := make([]string, len(header))
+		for i, k := range header {
+			values[i] = rows[sample][k].String()
+		}
+		fmt.Fprintf(w, "%s\t%s\n", sample, strings.Join(values, "\t"))
+	}
+	return w.Flush()
+}
+
+// rows returns the section data as a map of sample rows, keeping the numbers as written in JSON
+func (s *MultiQCSection) rows() (map[string]map[string]json.Number, error) {
+	b, err := json.Marshal(s.Data)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var rows map[string]map[string]json.Number
+	if err := dec.Decode(&rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// sortedColumns returns the column names sorted, numerically if they are all integers as
+// the x values of line graphs, or following the coverage categories order for bar graphs
+func sortedColumns(columns map[string]struct{}) []string {
+	var names []string
+	numeric := true
+	for k := range columns {
+		names = append(names, k)
+		if _, err := strconv.Atoi(k); err != nil {
+			numeric = false
+		}
+	}
+	order := make(map[string]int, len(coverageCategories))
+	for i, k := range coverageCategories {
+		order[k] = i
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if numeric {
+			a, _ := strconv.Atoi(names[i])
+			b, _ := strconv.Atoi(names[j])
+			return a < b
+		}
+		if oi, oj := rank(order, names[i]), rank(order, names[j]); oi != oj {
+			return oi < oj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// rank returns the position of k in order, placing the names not found last
+func rank(order map[string]int, k string) int {
+	if i, ok := order[k]; ok {
+		return i
+	}
+	return len(order)
+}
+
+func percentHeader(title, description, scale string) map[string]interface{} {
+	return map[string]interface{}{
+		"title":       title,
+		"description": description,
+		"min":         0,
+		"max":         100,
+		"suffix":      "%",
+		"format":      "{:,.2f}",
+		"scale":       scale,
+	}
+}
+
+func percent(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// MultiQC returns the MultiQC custom content sections for sm, with data for the given sample name:
+// the general statistics table columns and, when available, the coverage, multimap and insert sizes plots.
+func (sm Map) MultiQC(sample string) []*MultiQCSection {
+	var sections []*MultiQCSection
+	general := map[string]interface{}{}
+	headers := map[string]interface{}{}
+	g, hasGeneral := sm["general"].(*GeneralStats)
+	if hasGeneral {
+		mapped := g.Reads.Mapped.Total()
+		general["mapped_pct"] = percent(mapped, g.Reads.Total)
+		headers["mapped_pct"] = percentHeader("% Mapped", "Percentage of mapped reads", "RdYlGn")
+		general["duplicates_pct"] = percent(g.Reads.Duplicates, mapped)
+		headers["duplicates_pct"] = percentHeader("% Dups", "Percentage of duplicate reads over mapped reads", "RdYlGn-rev")
+	}
+	if r, ok := sm["rnaseq"].(*RNAseqStats); ok && r.Metrics != nil {
+		general["rrna_pct"] = 100 * float64(r.Metrics.RRNA)
+		headers["rrna_pct"] = percentHeader("% rRNA", "Percentage of mapped reads overlapping rRNA genes", "RdYlGn-rev")
+		general["intergenic_pct"] = 100 * float64(r.Metrics.Intergenic)
+		headers["intergenic_pct"] = percentHeader("% Intergenic", "Percentage of mapped reads in intergenic regions", "RdYlGn-rev")
+	}
+	if len(general) > 0 {
+		sections = append(sections, &MultiQCSection{
+			ID:       MultiQCGeneral,
+			PlotType: "generalstats",
+			Headers:  headers,
+			Data:     map[string]interface{}{sample: general},
+		})
+	}
+	if c, ok := sm["coverage"].(*CoverageStats); ok {
+		counts := map[string]uint64{}
+		for _, k := range coverageCategories {
+			counts[k] = c.Total[k]
+		}
+		sections = append(sections, &MultiQCSection{
+			ID:          MultiQCCoverage,
+			SectionName: "Genomic elements",
+			Description: "Number of mapped reads overlapping genomic elements.",
+			PlotType:    "bargraph",
+			Pconfig: map[string]interface{}{
+				"id":                    MultiQCCoverage + "_plot",
+				"title":                 "bamstats: Genomic elements",
+				"cpswitch_counts_label": "Number of reads",
+			},
+			Data: map[string]interface{}{sample: counts},
+		})
+	}
+	if hasGeneral {
+		if len(g.Reads.Mapped) > 0 {
+			sections = append(sections, &MultiQCSection{
+				ID:          MultiQCMultimap,
+				SectionName: "Multimapping reads",
+				Description: "Number of mapped reads by number of mapping locations.",
+				PlotType:    "bargraph",
+				Pconfig: map[string]interface{}{
+					"id":    MultiQCMultimap + "_plot",
+					"title": "bamstats: Multimapping reads",
+				},
+				Data: map[string]interface{}{sample: tagMapData(g.Reads.Mapped)},
+			})
+		}
+		if len(g.Pairs.InsertSizes) > 0 {
+			sections = append(sections, &MultiQCSection{
+				ID:          MultiQCInsertSizes,
+				SectionName: "Insert sizes",
+				Description: "Number of read pairs by insert size.",
+				PlotType:    "linegraph",
+				Pconfig: map[string]interface{}{
+					"id":        MultiQCInsertSizes + "_plot",
+					"title":     "bamstats: Insert sizes",
+					"xlab":      "Insert size (bp)",
+					"ylab":      "Read pairs",
+					"xDecimals": false,
+				},
+				Data: map[string]interface{}{sample: tagMapData(g.Pairs.InsertSizes)},
+			})
+		}
+	}
+	return sections
+}
+
+// tagMapData returns the TagMap as a map with string keys, as required by MultiQC
+func tagMapData(tm TagMap) map[string]uint64 {
+	m := make(map[string]uint64, len(tm))
+	for k, v := range tm {
+		m[strconv.Itoa(k)] = v
+	}
+	return m
+}
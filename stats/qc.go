@@ -0,0 +1,132 @@
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/guigolab/bamstats/sam"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// QC statuses
+const (
+	QCPass = "PASS"
+	QCWarn = "WARN"
+	QCFail = "FAIL"
+)
+
+var qcSeverity = map[string]int{
+	QCPass: 0,
+	QCWarn: 1,
+	QCFail: 2,
+}
+
+// Threshold represents the limits of a metric. Values outside the min/max limits fail
+// and values outside the warn_min/warn_max limits raise a warning.
+type Threshold struct {
+	Min     *float64 `json:"min,omitempty" yaml:"min"`
+	Max     *float64 `json:"max,omitempty" yaml:"max"`
+	WarnMin *float64 `json:"warn_min,omitempty" yaml:"warn_min"`
+	WarnMax *float64 `json:"warn_max,omitempty" yaml:"warn_max"`
+}
+
+// Status returns the QC status of a value
+func (t *Threshold) Status(v float64) string {
+	switch {
+	case t.Min != nil && v < *t.Min, t.Max != nil && v > *t.Max:
+		return QCFail
+	case t.WarnMin != nil && v < *t.WarnMin, t.WarnMax != nil && v > *t.WarnMax:
+		return QCWarn
+	default:
+		return QCPass
+	}
+}
+
+// Thresholds maps metric paths, e.g. rnaseq.metrics.fraction_intergenic, to their limits.
+type Thresholds map[string]*Threshold
+
+// ReadThresholds reads a thresholds file in YAML or JSON format.
+func ReadThresholds(fileName string) (Thresholds, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var t Thresholds
+	if err := yaml.UnmarshalStrict(b, &t); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	for p, th := range t {
+		if th == nil {
+			return nil, fmt.Errorf("%s: no limits given for %s", fileName, p)
+		}
+	}
+	return t, nil
+}
+
+// QCMetric represents the QC evaluation of a metric
+type QCMetric struct {
+	Value *float64 `json:"value"`
+	Threshold
+	Status string `json:"status"`
+}
+
+// QCStats represents the QC evaluation of the statistics against a set of thresholds.
+type QCStats struct {
+	Status  string               `json:"status"`
+	Metrics map[string]*QCMetric `json:"metrics"`
+}
+
+// Type returns the type of stats
+func (s *QCStats) Type() string {
+	return "qc"
+}
+
+// Update does nothing, as QC statuses are computed from finalized statistics.
+func (s *QCStats) Update(other Stats) {}
+
+// Merge does nothing, as QC statuses are computed from finalized statistics.
+func (s *QCStats) Merge(others chan Stats) {}
+
+// Collect does nothing, as QC statuses are computed from finalized statistics.
+func (s *QCStats) Collect(record *sam.Record) {}
+
+// Finalize does nothing, as QC statuses are computed from finalized statistics.
+func (s *QCStats) Finalize() {}
+
+// Failed returns true if the overall status is FAIL
+func (s *QCStats) Failed() bool {
+	return s.Status == QCFail
+}
+
+// EvaluateQC checks the finalized statistics of sm against the thresholds and returns the
+// status of each metric along with the overall status, which is the worst metric status.
+// Metrics not found in sm get a WARN status.
+func EvaluateQC(sm Map, thresholds Thresholds) (*QCStats, error) {
+	values, _, err := sm.Values()
+	if err != nil {
+		return nil, err
+	}
+	qc := &QCStats{
+		Status:  QCPass,
+		Metrics: make(map[string]*QCMetric),
+	}
+	var paths []string
+	for p := range thresholds {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		t := thresholds[p]
+		m := &QCMetric{Threshold: *t, Status: QCWarn}
+		if v, ok := values[p]; ok {
+			m.Value = &v
+			m.Status = t.Status(v)
+		}
+		qc.Metrics[p] = m
+		if qcSeverity[m.Status] > qcSeverity[qc.Status] {
+			qc.Status = m.Status
+		}
+	}
+	return qc, nil
+}
@@ -0,0 +1,210 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/guigolab/bamstats/annotation"
+	"github.com/guigolab/bamstats/config"
+)
+
+// Constructor returns a new Stats instance collecting statistics with the given
+// annotation index and settings. The index is nil when no annotation is available.
+type Constructor func(index *annotation.RtreeMap, cfg *config.Config) Stats
+
+// Factory returns a new empty Stats instance, used for reading a section of the JSON output.
+type Factory func() Stats
+
+type collector struct {
+	constructor     Constructor
+	needsAnnotation bool
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]collector)
+	sections   = make(map[string]Factory)
+)
+
+// DefaultCollectors are the statistics collected when none are specified in the configuration.
+var DefaultCollectors = []string{"general", "coverage", "rnaseq"}
+
+func init() {
+	Register("general", func(index *annotation.RtreeMap, cfg *config.Config) Stats {
+		return NewGeneralStats()
+	}, false)
+	Register("coverage", func(index *annotation.RtreeMap, cfg *config.Config) Stats {
+		if cfg.Fragments {
+			return NewFragmentCoverageStats(index, false)
+		}
+		return NewCoverageStats(index, false)
+	}, true)
+	Register("coverageUniq", func(index *annotation.RtreeMap, cfg *config.Config) Stats {
+		if cfg.Fragments {
+			return NewFragmentCoverageStats(index, true)
+		}
+		return NewCoverageStats(index, true)
+	}, true)
+	Register("rnaseq", func(index *annotation.RtreeMap, cfg *config.Config) Stats {
+		if cfg.Fragments {
+			return NewFragmentIHECstats(index, cfg.BiotypeTag, cfg.BiotypeMode)
+		}
+		return NewIHECstatsWithBiotypes(index, cfg.BiotypeTag, cfg.BiotypeMode)
+	}, true)
+	Register("chimeric", func(index *annotation.RtreeMap, cfg *config.Config) Stats {
+		return NewChimericStats()
+	}, false)
+	RegisterSection("qc", func() Stats {
+		return &QCStats{}
+	})
+	RegisterSection("meta", func() Stats {
+		return &Meta{}
+	})
+}
+
+// Register makes a statistics collector available by name. Collectors needing an annotation
+// are only created when an annotation index is available. The name should match the Type of
+// the created Stats. The collector output is read back from JSON into instances created with
+// no annotation and the default settings. Register panics if a collector with the same name
+// is already registered.
+func Register(name string, c Constructor, needsAnnotation bool) {
+	if c == nil {
+		panic("stats: Register constructor is nil")
+	}
+	registryMu.Lock()
+	if _, dup := registry[name]; dup {
+		registryMu.Unlock()
+		panic("stats: Register called twice for " + name)
+	}
+	registry[name] = collector{c, needsAnnotation}
+	registryMu.Unlock()
+	RegisterSection(name, func() Stats {
+		return c(nil, config.NewConfig(1, 0, -1, false))
+	})
+}
+
+// RegisterSection makes a section of the JSON output readable by name, using f for creating
+// the Stats instances it is read into. Collectors added with Register are registered as well.
+// RegisterSection panics if a section with the same name is already registered.
+func RegisterSection(name string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if f == nil {
+		panic("stats: RegisterSection factory is nil")
+	}
+	if _, dup := sections[name]; dup {
+		panic("stats: RegisterSection called twice for " + name)
+	}
+	sections[name] = f
+}
+
+// newSection returns a new empty Stats instance for the named section of the JSON output, or
+// nil if the section is unknown.
+func newSection(name string) Stats {
+	registryMu.RLock()
+	f, ok := sections[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return f()
+}
+
+// Collectors returns the sorted names of the registered statistics collectors.
+func Collectors() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return collectorNames()
+}
+
+func collectorNames() []string {
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewMapFromConfig returns a Map with the collectors listed in cfg.Stats, or the default ones
+// if the list is empty. Default collectors needing an annotation are skipped when index is nil,
+// while an error is returned if they are explicitly requested. If cfg.Uniq is set, coverage
+// statistics for uniquely mapped reads are added when coverage statistics are collected.
+func NewMapFromConfig(index *annotation.RtreeMap, cfg *config.Config) (Map, error) {
+	names := cfg.Stats
+	explicit := len(names) > 0
+	if !explicit {
+		names = DefaultCollectors
+	}
+	if cfg.Uniq && contains(names, "coverage") && !contains(names, "coverageUniq") {
+		names = append(names[:len(names):len(names)], "coverageUniq")
+	}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	m := make(Map)
+	for _, name := range names {
+		c, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown stats: %s (available: %s)", name, strings.Join(collectorNames(), ","))
+		}
+		if c.needsAnnotation && index == nil {
+			if explicit {
+				return nil, fmt.Errorf("%s stats require an annotation", name)
+			}
+			continue
+		}
+		s := c.constructor(index, cfg)
+		if s == nil {
+			continue
+		}
+		m.Add(s)
+	}
+	m.setMateLimits(cfg)
+	return m, nil
+}
+
+// setMateLimits shares half of the memory budget, left by the reader for the mates buffered
+// in fragment mode, among the collectors of the map, one map for each worker.
+func (m Map) setMateLimits(cfg *config.Config) {
+	if !cfg.Fragments || cfg.MaxMem <= 0 {
+		return
+	}
+	var fs []*fragments
+	for _, s := range m {
+		switch s := s.(type) {
+		case *CoverageStats:
+			if s.fragments != nil {
+				fs = append(fs, s.fragments)
+			}
+		case *RNAseqStats:
+			if s.fragments != nil {
+				fs = append(fs, s.fragments)
+			}
+		}
+	}
+	if len(fs) == 0 {
+		return
+	}
+	workers := cfg.Cpu
+	if workers < 1 {
+		workers = 1
+	}
+	limit := int(int64(cfg.MaxMem) / 2 / mateMem / int64(workers*len(fs)))
+	if limit < 1 {
+		limit = 1
+	}
+	for _, f := range fs {
+		f.limit = limit
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
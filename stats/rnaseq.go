@@ -1,6 +1,8 @@
 package stats
 
 import (
+	"encoding/json"
+
 	"github.com/dhconnelly/rtreego"
 	"github.com/guigolab/bamstats/annotation"
 	"github.com/guigolab/bamstats/sam"
@@ -8,10 +10,17 @@ import (
 
 // RNAseqMetrics represents statistics for mapped reads
 type RNAseqMetrics struct {
-	Mapped     fraction `json:"fraction_mapped,omitempty"`
-	Intergenic fraction `json:"fraction_intergenic,omitempty"`
-	RRNA       fraction `json:"fraction_rrna,omitempty"`
-	Duplicates fraction `json:"fraction_duplicates,omitempty"`
+	Mapped     fraction `json:"fraction_mapped"`
+	Intergenic fraction `json:"fraction_intergenic"`
+	RRNA       fraction `json:"fraction_rrna"`
+	Duplicates fraction `json:"fraction_duplicates"`
+}
+
+// RNAseqCounts represents the read or fragment counts used for the metrics
+type RNAseqCounts struct {
+	Total      uint64 `json:"total"`
+	Mapped     uint64 `json:"mapped"`
+	Duplicates uint64 `json:"duplicates"`
 }
 
 // RNAseqStats represents statistics for mapped reads
@@ -19,8 +28,16 @@ type RNAseqStats struct {
 	total, mapped, duplicates uint64
 	Intergenic                uint64         `json:"intergenic"`
 	RRNA                      uint64         `json:"rRNA"`
-	Metrics                   *RNAseqMetrics `json:"metrics,omitempty"`
+	Biotypes                  BiotypeStats   `json:"biotypes"`
+	Metrics                   *RNAseqMetrics `json:"metrics"`
+	Reads                     *RNAseqCounts  `json:"reads,omitempty"`
+	Fragments                 *RNAseqCounts  `json:"fragments,omitempty"`
 	index                     *annotation.RtreeMap
+	biotypeTag, biotypeMode   string
+	// fragment mode: mates not yet paired, unmapped reads and mapped reads with an unmapped mate
+	fragments            *fragments
+	unmapped, halfMapped uint64
+	paired               bool
 }
 
 // Type returns the type of stats
@@ -43,19 +60,52 @@ func (s *RNAseqStats) Update(other Stats) {
 	if other, isIHEC := other.(*RNAseqStats); isIHEC {
 		s.Intergenic += other.Intergenic
 		s.RRNA += other.RRNA
+		s.Biotypes.Update(other.Biotypes)
 		s.duplicates += other.duplicates
 		s.total += other.total
 		s.mapped += other.mapped
+		s.unmapped += other.unmapped
+		s.halfMapped += other.halfMapped
+		s.paired = s.paired || other.paired
+		if s.fragments != nil && other.fragments != nil {
+			s.fragments.update(other.fragments)
+		}
+		if other.Fragments != nil && s.Fragments == nil {
+			s.Fragments = &RNAseqCounts{}
+		}
 	}
 }
 
-// UpdateTotal adds amount to total
+// UpdateTotal adds amount to total. In fragment mode, amount is the number of unmapped
+// reads, counted as fragments when finalizing.
 func (s *RNAseqStats) UpdateTotal(amount uint64) {
+	if s.fragments != nil {
+		s.unmapped += amount
+		return
+	}
 	s.total += amount
 }
 
 // Finalize updates dependent counts of a Stats instance.
 func (s *RNAseqStats) Finalize() {
+	if s.fragments != nil {
+		s.fragments.flush()
+		// unmapped reads with a mapped mate belong to fragments already counted
+		var unmapped uint64
+		if s.unmapped > s.halfMapped {
+			unmapped = s.unmapped - s.halfMapped
+		}
+		if s.paired {
+			unmapped = (unmapped + 1) / 2
+		}
+		s.total += unmapped
+		s.unmapped, s.halfMapped = 0, 0
+	}
+	if s.Fragments != nil {
+		*s.Fragments = RNAseqCounts{s.total, s.mapped, s.duplicates}
+	} else {
+		s.Reads = &RNAseqCounts{s.total, s.mapped, s.duplicates}
+	}
 	if s.total > 0 {
 		s.Metrics.Mapped = fraction(s.mapped) / fraction(s.total)
 		if s.mapped > 0 {
@@ -66,39 +116,152 @@ func (s *RNAseqStats) Finalize() {
 	}
 }
 
-// Collect collects general mapping statistics from a sam.Record.
+// Collect collects general mapping statistics from a sam.Record. In fragment mode, the
+// mates of paired reads are collected together when both are available.
 func (s *RNAseqStats) Collect(record *sam.Record) {
-	elements := map[string]uint8{}
 	if s.index == nil || !record.IsPrimary() {
 		return
 	}
-	s.total++
+	if s.fragments != nil {
+		s.addRead(record)
+		return
+	}
 	if record.IsUnmapped() {
+		s.total++
 		return
 	}
+	s.collectFragment(record)
+}
+
+// addRead adds a read to the fragments, keeping track of the unmapped reads.
+func (s *RNAseqStats) addRead(record *sam.Record) {
+	if record.IsSupplementary() {
+		return
+	}
+	if record.IsUnmapped() {
+		s.unmapped++
+		return
+	}
+	if record.IsPaired() {
+		s.paired = true
+		if record.HasMateUnmapped() {
+			s.halfMapped++
+		}
+	}
+	s.fragments.add(record)
+}
+
+// collectFragment collects RNA-seq statistics for the union of the elements and genes
+// overlapping the given mapped reads.
+func (s *RNAseqStats) collectFragment(reads ...*sam.Record) {
+	s.total++
 	s.mapped++
-	if record.IsDuplicate() {
+	elements := map[string]uint8{}
+	biotypes := map[string]uint8{}
+	duplicate, annotated := false, false
+	for _, record := range reads {
+		duplicate = duplicate || record.IsDuplicate()
+		mappingLocation := annotation.NewLocation(record.Ref.Name(), record.Start(), record.End())
+		rtree := s.index.Get(mappingLocation.Chrom())
+		if rtree == nil || rtree.Size() == 0 {
+			continue
+		}
+		annotated = true
+		results := annotation.QueryIndex(rtree, mappingLocation.Start(), mappingLocation.End())
+		mappingLocation.GetElements(filterElements(results, mappingLocation.Start(), mappingLocation.End(), 500), elements, s.biotypeTag)
+		mappingLocation.GetElements(filterGenes(results), biotypes, s.biotypeTag)
+	}
+	if duplicate {
 		s.duplicates++
 	}
-	mappingLocation := annotation.NewLocation(record.Ref.Name(), record.Start(), record.End())
-	rtree := s.index.Get(mappingLocation.Chrom())
-	if rtree == nil || rtree.Size() == 0 {
+	if !annotated {
+		updateBiotypeCount(biotypes, s.biotypeMode, s.Biotypes)
 		return
 	}
+	if n, ok := biotypes[""]; ok {
+		delete(biotypes, "")
+		biotypes[Unknown] += n
+	}
 
-	results := annotation.QueryIndex(rtree, mappingLocation.Start(), mappingLocation.End())
+	updateIHECcount(elements, s)
+	updateBiotypeCount(biotypes, s.biotypeMode, s.Biotypes)
+}
 
-	mappingLocation.GetElements(filterElements(results, mappingLocation.Start(), mappingLocation.End(), 500), elements, "gene_type")
+// UnmarshalJSON parses a JSON representation of a RNAseqStats instance. The total, mapped
+// and duplicate counts are restored from the reads or fragments sections. JSON written by
+// previous versions does not have them, and they must be restored with SetReadCounts to
+// recompute the metrics.
+func (s *RNAseqStats) UnmarshalJSON(b []byte) error {
+	type rnaseqStats RNAseqStats
+	rs := rnaseqStats(*NewIHECstatsWithBiotypes(nil, s.biotypeTag, s.biotypeMode))
+	if err := json.Unmarshal(b, &rs); err != nil {
+		return err
+	}
+	*s = RNAseqStats(rs)
+	if s.Biotypes == nil {
+		s.Biotypes = make(BiotypeStats)
+	}
+	if s.Metrics == nil {
+		s.Metrics = &RNAseqMetrics{}
+	}
+	counts := s.Fragments
+	if counts == nil {
+		counts = s.Reads
+	}
+	if counts != nil {
+		s.total, s.mapped, s.duplicates = counts.Total, counts.Mapped, counts.Duplicates
+	}
+	return nil
+}
 
-	updateIHECcount(elements, s)
+// SetReadCounts sets the total, mapped and duplicate read counts from the general statistics
+// collected from the same records. Counts read from JSON are kept, as well as counts in
+// fragment mode, as they are not read counts.
+func (s *RNAseqStats) SetReadCounts(g *GeneralStats) {
+	if s.Reads != nil || s.Fragments != nil {
+		return
+	}
+	s.total = g.Reads.Total
+	s.mapped = g.Reads.Mapped.Total()
+	s.duplicates = g.Reads.Duplicates
 }
 
-// NewIHECstats creates a new instance of IHECstats
+// NewIHECstats creates a new instance of IHECstats. Gene biotypes are read from the gene_type
+// attribute and reads overlapping genes with different biotypes are counted as ambiguous.
 func NewIHECstats(index *annotation.RtreeMap) *RNAseqStats {
+	return NewIHECstatsWithBiotypes(index, "gene_type", BiotypeAmbiguous)
+}
+
+// NewIHECstatsWithBiotypes creates a new instance of IHECstats. Gene biotypes are read from the
+// biotypeTag attribute and reads overlapping genes with different biotypes are counted according
+// to biotypeMode.
+func NewIHECstatsWithBiotypes(index *annotation.RtreeMap, biotypeTag, biotypeMode string) *RNAseqStats {
 	return &RNAseqStats{
-		index:   index,
-		Metrics: &RNAseqMetrics{},
+		index:       index,
+		Biotypes:    make(BiotypeStats),
+		Metrics:     &RNAseqMetrics{},
+		biotypeTag:  biotypeTag,
+		biotypeMode: biotypeMode,
+	}
+}
+
+// NewFragmentIHECstats creates a new instance of IHECstats counting fragments, with the
+// mates of paired reads classified as a unit.
+func NewFragmentIHECstats(index *annotation.RtreeMap, biotypeTag, biotypeMode string) *RNAseqStats {
+	s := NewIHECstatsWithBiotypes(index, biotypeTag, biotypeMode)
+	s.fragments = newFragments(s.Type(), s.collectFragment)
+	s.Fragments = &RNAseqCounts{}
+	return s
+}
+
+func filterGenes(elements []rtreego.Spatial) []rtreego.Spatial {
+	var genes []rtreego.Spatial
+	for _, r := range elements {
+		if r, ok := r.(*annotation.Feature); ok && r.Element() == "gene" {
+			genes = append(genes, r)
+		}
 	}
+	return genes
 }
 
 func filterElements(elements []rtreego.Spatial, start, end, offset float64) []rtreego.Spatial {
@@ -2,12 +2,14 @@ package stats
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"strconv"
 
 	"github.com/guigolab/bamstats/sam"
+	log "github.com/sirupsen/logrus"
 )
 
 type fraction float64
@@ -24,6 +26,30 @@ func (m fraction) MarshalJSON() ([]byte, error) {
 	return json.Marshal(v)
 }
 
+// marshalOrdered returns the JSON representation of an object having the given keys, in order.
+func marshalOrdered(keys []string, value func(string) interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		vb, err := json.Marshal(value(k))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(kb)
+		buf.WriteByte(':')
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
 // Stats represents mapping statistics.
 type Stats interface {
 	Type() string
@@ -65,6 +91,45 @@ func (sm Map) OutputJSON(writer io.Writer) error {
 	return nil
 }
 
+// UnmarshalJSON parses a JSON representation of a Map. Sections are read into the Stats
+// instances of the registered collectors and sections, and unknown sections are skipped.
+// The RNAseqStats read counts missing in JSON written by previous versions are restored
+// from the general statistics.
+func (sm *Map) UnmarshalJSON(b []byte) error {
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(b, &sections); err != nil {
+		return err
+	}
+	m := make(Map)
+	for key, raw := range sections {
+		s := newSection(key)
+		if s == nil {
+			log.Warnf("Unknown stats section %s skipped", key)
+			continue
+		}
+		if err := json.Unmarshal(raw, s); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		m[key] = s
+	}
+	if r, ok := m["rnaseq"].(*RNAseqStats); ok {
+		if g, ok := m["general"].(*GeneralStats); ok {
+			r.SetReadCounts(g)
+		}
+	}
+	*sm = m
+	return nil
+}
+
+// ReadJSON reads a Map from a JSON representation
+func ReadJSON(r io.Reader) (Map, error) {
+	var m Map
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 //NewMap creates and instance of a stats.Map
 func NewMap(stats ...Stats) Map {
 	m := make(Map)
@@ -0,0 +1,141 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+)
+
+// chart dimensions
+const (
+	chartWidth   = 720
+	chartHeight  = 300
+	chartMarginL = 70
+	chartMarginR = 20
+	chartMarginT = 30
+	chartMarginB = 60
+)
+
+var chartColors = []string{"#4e79a7", "#f28e2b", "#59a14f", "#e15759"}
+
+// series represents a named set of values to plot
+type series struct {
+	Name   string
+	Values []float64
+}
+
+func maxValue(ss []series) float64 {
+	var max float64
+	for _, s := range ss {
+		for _, v := range s.Values {
+			max = math.Max(max, v)
+		}
+	}
+	if max == 0 {
+		return 1
+	}
+	return max
+}
+
+func formatTick(v float64) string {
+	switch {
+	case v >= 1e6:
+		return fmt.Sprintf("%.3gM", v/1e6)
+	case v >= 1e3:
+		return fmt.Sprintf("%.3gk", v/1e3)
+	default:
+		return fmt.Sprintf("%.3g", v)
+	}
+}
+
+// axes draws the y axis with ticks and the x axis baseline
+func axes(buf *bytes.Buffer, max float64, ylab string) {
+	plotH := float64(chartHeight - chartMarginT - chartMarginB)
+	for i := 0; i <= 4; i++ {
+		v := max * float64(i) / 4
+		y := float64(chartHeight-chartMarginB) - plotH*float64(i)/4
+		fmt.Fprintf(buf, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`, chartMarginL, y, chartWidth-chartMarginR, y)
+		fmt.Fprintf(buf, `<text x="%d" y="%.1f" text-anchor="end" font-size="11">%s</text>`, chartMarginL-6, y+4, formatTick(v))
+	}
+	fmt.Fprintf(buf, `<text x="14" y="%d" font-size="12" transform="rotate(-90 14 %d)" text-anchor="middle">%s</text>`,
+		chartHeight/2, chartHeight/2, template.HTMLEscapeString(ylab))
+}
+
+func legend(buf *bytes.Buffer, ss []series) {
+	if len(ss) < 2 {
+		return
+	}
+	for i, s := range ss {
+		x := chartMarginL + i*140
+		fmt.Fprintf(buf, `<rect x="%d" y="8" width="12" height="12" fill="%s"/>`, x, chartColors[i%len(chartColors)])
+		fmt.Fprintf(buf, `<text x="%d" y="18" font-size="12">%s</text>`, x+16, template.HTMLEscapeString(s.Name))
+	}
+}
+
+// barChart returns an SVG bar chart, with a group of bars for each label
+func barChart(labels []string, ss []series, ylab string) template.HTML {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, chartWidth, chartHeight, chartWidth, chartHeight)
+	max := maxValue(ss)
+	axes(&buf, max, ylab)
+	legend(&buf, ss)
+	plotW := float64(chartWidth - chartMarginL - chartMarginR)
+	plotH := float64(chartHeight - chartMarginT - chartMarginB)
+	groupW := plotW / float64(len(labels))
+	barW := groupW * 0.8 / float64(len(ss))
+	for i, label := range labels {
+		x0 := float64(chartMarginL) + groupW*float64(i) + groupW*0.1
+		for j, s := range ss {
+			h := plotH * s.Values[i] / max
+			fmt.Fprintf(&buf, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s %s: %s</title></rect>`,
+				x0+barW*float64(j), float64(chartHeight-chartMarginB)-h, barW, h, chartColors[j%len(chartColors)],
+				template.HTMLEscapeString(s.Name), template.HTMLEscapeString(label), formatValue(s.Values[i]))
+		}
+		if len(labels) <= 30 || i%(len(labels)/30+1) == 0 {
+			fmt.Fprintf(&buf, `<text x="%.1f" y="%d" font-size="11" text-anchor="end" transform="rotate(-35 %.1f %d)">%s</text>`,
+				x0+groupW*0.4, chartHeight-chartMarginB+14, x0+groupW*0.4, chartHeight-chartMarginB+14, template.HTMLEscapeString(label))
+		}
+	}
+	buf.WriteString(`</svg>`)
+	return template.HTML(buf.String())
+}
+
+// lineChart returns an SVG line chart of y values over numeric x values
+func lineChart(xs []float64, s series, xlab, ylab string) template.HTML {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, chartWidth, chartHeight, chartWidth, chartHeight)
+	max := maxValue([]series{s})
+	axes(&buf, max, ylab)
+	plotW := float64(chartWidth - chartMarginL - chartMarginR)
+	plotH := float64(chartHeight - chartMarginT - chartMarginB)
+	if len(xs) > 0 {
+		minX, maxX := xs[0], xs[len(xs)-1]
+		if maxX == minX {
+			maxX = minX + 1
+		}
+		scaleX := func(x float64) float64 {
+			return float64(chartMarginL) + plotW*(x-minX)/(maxX-minX)
+		}
+		buf.WriteString(`<polyline fill="none" stroke="` + chartColors[0] + `" stroke-width="1.5" points="`)
+		for i, x := range xs {
+			fmt.Fprintf(&buf, "%.1f,%.1f ", scaleX(x), float64(chartHeight-chartMarginB)-plotH*s.Values[i]/max)
+		}
+		buf.WriteString(`"/>`)
+		for i := 0; i <= 4; i++ {
+			x := minX + (maxX-minX)*float64(i)/4
+			fmt.Fprintf(&buf, `<text x="%.1f" y="%d" font-size="11" text-anchor="middle">%s</text>`, scaleX(x), chartHeight-chartMarginB+16, formatTick(math.Round(x)))
+		}
+	}
+	fmt.Fprintf(&buf, `<text x="%d" y="%d" font-size="12" text-anchor="middle">%s</text>`,
+		chartMarginL+int(plotW)/2, chartHeight-16, template.HTMLEscapeString(xlab))
+	buf.WriteString(`</svg>`)
+	return template.HTML(buf.String())
+}
+
+func formatValue(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.4g", v)
+}
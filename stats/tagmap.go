@@ -1,9 +1,7 @@
 package stats
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
 	"sort"
 	"strconv"
 )
@@ -33,23 +31,19 @@ func (tm TagMap) Total() (sum uint64) {
 
 // MarshalJSON returns a JSON representation of a TagMap, numerically sorting the keys.
 func (tm TagMap) MarshalJSON() ([]byte, error) {
-	buf := &bytes.Buffer{}
-	buf.Write([]byte{'{', '\n'})
-	var keys []int
+	var ints []int
 	for k := range tm {
-		keys = append(keys, k)
+		ints = append(ints, k)
 	}
-	sort.Ints(keys)
-	l := len(keys)
-	for i, k := range keys {
-		fmt.Fprintf(buf, "\t\"%d\": %v", k, tm[k])
-		if i < l-1 {
-			buf.WriteByte(',')
-		}
-		buf.WriteByte('\n')
+	sort.Ints(ints)
+	keys := make([]string, len(ints))
+	for i, k := range ints {
+		keys[i] = strconv.Itoa(k)
 	}
-	buf.Write([]byte{'}', '\n'})
-	return buf.Bytes(), nil
+	return marshalOrdered(keys, func(k string) interface{} {
+		i, _ := strconv.Atoi(k)
+		return tm[i]
+	})
 }
 
 // UnmarshalJSON parse a JSON representation of a TagMap.
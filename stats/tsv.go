@@ -0,0 +1,110 @@
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// TSVHeader is the header line of the tabular output
+var TSVHeader = []string{"section", "subsection", "key", "value"}
+
+// Row represents a flattened statistic, the subsection being the path of the parent keys joined by dots.
+type Row struct {
+	Section, Subsection, Key, Value string
+}
+
+// Path returns the full path of the statistic, e.g. rnaseq.metrics.fraction_rrna
+func (r Row) Path() string {
+	var parts []string
+	for _, p := range []string{r.Section, r.Subsection, r.Key} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// Rows returns the statistics of sm flattened into rows. Sections are sorted by name
+// and rows within a section follow the JSON output order.
+func (sm Map) Rows() ([]Row, error) {
+	var rows []Row
+	var sections []string
+	for k := range sm {
+		sections = append(sections, k)
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		b, err := json.Marshal(sm[section])
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		err = flatten(dec, nil, func(path []string, value string) {
+			r := Row{Section: section, Value: value}
+			if len(path) > 0 {
+				r.Subsection = strings.Join(path[:len(path)-1], ".")
+				r.Key = path[len(path)-1]
+			}
+			rows = append(rows, r)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// OutputTSV writes sm to the writer as tab separated section, subsection, key and value rows.
+// Nested objects are flattened, the subsection being the path of the parent keys joined by dots.
+func (sm Map) OutputTSV(writer io.Writer) error {
+	rows, err := sm.Rows()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(writer)
+	fmt.Fprintln(w, strings.Join(TSVHeader, "\t"))
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Section, r.Subsection, r.Key, r.Value)
+	}
+	return w.Flush()
+}
+
+// flatten reads a JSON value from dec and calls out for each leaf value with the path of its keys.
+// Array elements are keyed by their index.
+func flatten(dec *json.Decoder, path []string, out func([]string, string)) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := t.(type) {
+	case json.Delim:
+		isArray := t == '['
+		for i := 0; dec.More(); i++ {
+			key := fmt.Sprint(i)
+			if !isArray {
+				k, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key = k.(string)
+			}
+			if err := flatten(dec, append(path[:len(path):len(path)], key), out); err != nil {
+				return err
+			}
+		}
+		// closing delimiter
+		_, err = dec.Token()
+		return err
+	case nil:
+		out(path, "")
+	default:
+		out(path, fmt.Sprint(t))
+	}
+	return nil
+}
@@ -2,8 +2,11 @@ package utils
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // Max returns the maximum of two integers
@@ -35,3 +38,49 @@ func NewWriter(output string) io.Writer {
 		return bufio.NewWriter(f)
 	}
 }
+
+// Flush flushes w if it is a buffered writer.
+func Flush(w io.Writer) error {
+	if bw, ok := w.(*bufio.Writer); ok {
+		return bw.Flush()
+	}
+	return nil
+}
+
+var sizeUnits = []string{"K", "M", "G", "T"}
+
+// ParseSize parses a size in bytes with an optional binary unit suffix, e.g. 512M or 2G.
+// A trailing B, as in 2GB, is allowed.
+func ParseSize(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	for i, u := range sizeUnits {
+		if strings.HasSuffix(v, u) {
+			v = strings.TrimSuffix(v, u)
+			mult = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// FormatSize returns a human readable representation of a size in bytes, using binary units.
+func FormatSize(n uint64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	v := float64(n)
+	unit := ""
+	for _, u := range sizeUnits {
+		if v < 1024 {
+			break
+		}
+		v /= 1024
+		unit = u
+	}
+	return fmt.Sprintf("%.1f%s", v, unit)
+}
@@ -31,3 +31,43 @@ func TestMin(t *testing.T) {
 		}
 	}
 }
+
+func TestParseSize(t *testing.T) {
+	for i, c := range []struct {
+		size     string
+		expected int64
+	}{
+		{"1024", 1024},
+		{"2K", 2048},
+		{"1.5M", 1572864},
+		{"2G", 2147483648},
+		{"2gb", 2147483648},
+		{"1T", 1099511627776},
+	} {
+		n, err := ParseSize(c.size)
+		if err != nil || n != c.expected {
+			t.Errorf("[%d] Expected %v, got %v (%v)", i, c.expected, n, err)
+		}
+	}
+	for _, s := range []string{"", "G", "-1M", "2X"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for i, c := range []struct {
+		size     uint64
+		expected string
+	}{
+		{512, "512B"},
+		{2048, "2.0K"},
+		{1572864, "1.5M"},
+		{2147483648, "2.0G"},
+	} {
+		if s := FormatSize(c.size); s != c.expected {
+			t.Errorf("[%d] Expected %v, got %v", i, c.expected, s)
+		}
+	}
+}